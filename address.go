@@ -0,0 +1,66 @@
+package orflog
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Address is email address from Sender or Recipients with normalized parts
+type Address struct {
+	Raw           string // as logged by ORF
+	Local         string // local part, case preserved
+	Domain        string // lowercase ASCII (punycode) form of the domain
+	DomainUnicode string // lowercase unicode form of the domain
+	Normalized    string // Local@Domain, empty for null sender
+	Null          bool   // null sender <> used by bounces
+	Bounce        bool   // null sender or address of bounce messages like mailer-daemon@
+}
+
+// bounceLocals lists local parts (or their prefixes with trailing "*") used to send bounces
+var bounceLocals = []string{"mailer-daemon", "bounce*", "bounces*"}
+
+// ParseAddress normalizes email address: strips angle brackets and spaces, lowercases domain
+// and converts it to punycode, detects null sender and bounce addresses
+func ParseAddress(raw string) Address {
+	res := Address{Raw: raw}
+
+	addr := strings.TrimSpace(raw)
+	addr = strings.TrimPrefix(addr, "<")
+	addr = strings.TrimSuffix(addr, ">")
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		res.Null, res.Bounce = true, true
+		return res
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		res.Local, res.Normalized = addr, addr
+		res.Bounce = isBounceLocal(addr)
+		return res
+	}
+
+	res.Local = addr[:at]
+	domain := strings.TrimSuffix(strings.ToLower(addr[at+1:]), ".")
+	res.Domain, res.DomainUnicode = domain, domain
+	if ascii, err := idna.Punycode.ToASCII(domain); err == nil {
+		res.Domain = ascii
+	}
+	if unicode, err := idna.Punycode.ToUnicode(res.Domain); err == nil {
+		res.DomainUnicode = unicode
+	}
+	res.Normalized = res.Local + "@" + res.Domain
+	res.Bounce = isBounceLocal(res.Local)
+	return res
+}
+
+func isBounceLocal(local string) bool {
+	local = strings.ToLower(local)
+	for _, b := range bounceLocals {
+		if strings.HasSuffix(b, "*") && strings.HasPrefix(local, strings.TrimSuffix(b, "*")) || local == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package orflog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddress(t *testing.T) {
+	tbl := []struct {
+		raw  string
+		want Address
+	}{
+		{"<John.Doe@Example.COM>", Address{Local: "John.Doe", Domain: "example.com", DomainUnicode: "example.com",
+			Normalized: "John.Doe@example.com"}},
+		{"user@München.de", Address{Local: "user", Domain: "xn--mnchen-3ya.de", DomainUnicode: "münchen.de",
+			Normalized: "user@xn--mnchen-3ya.de"}},
+		{"user@xn--e1afmkfd.xn--p1ai.", Address{Local: "user", Domain: "xn--e1afmkfd.xn--p1ai", DomainUnicode: "пример.рф",
+			Normalized: "user@xn--e1afmkfd.xn--p1ai"}},
+		{"<>", Address{Null: true, Bounce: true}},
+		{"MAILER-DAEMON@example.com", Address{Local: "MAILER-DAEMON", Domain: "example.com", DomainUnicode: "example.com",
+			Normalized: "MAILER-DAEMON@example.com", Bounce: true}},
+		{"bounces+123@list.example.com", Address{Local: "bounces+123", Domain: "list.example.com", DomainUnicode: "list.example.com",
+			Normalized: "bounces+123@list.example.com", Bounce: true}},
+		{"postmaster", Address{Local: "postmaster", Normalized: "postmaster"}},
+	}
+
+	for _, tt := range tbl {
+		tt.want.Raw = tt.raw
+		assert.Equal(t, tt.want, ParseAddress(tt.raw), tt.raw)
+	}
+}
+
+func TestParseAddressInvalidPunycode(t *testing.T) {
+	addr := ParseAddress("user@xn--a!.example.com")
+	assert.Equal(t, "xn--a!.example.com", addr.Domain)
+	assert.Equal(t, "xn--a!.example.com", addr.DomainUnicode)
+}
@@ -0,0 +1,634 @@
+package orflog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive keeps records in compressed columnar files partitioned by day of record time (UTC),
+// one file per day named 2006-01-02.orfa. File format:
+//
+//	file    = magic "ORFA" version(1 byte) block*
+//	block   = size(uint32) min(int64) max(int64) gzip(columns)   big endian, min and max are record times in unix ns
+//	columns = count(uvarint) column*
+//
+// Columns follow in order of archiveColumns, every column has count values:
+//
+//	time    - varint delta of unix ns from the previous record (from 0 for the first one)
+//	dict    - uvarint dictionary size, dictionary strings, uvarint dictionary index for every record
+//	string  - uvarint length and bytes for every record
+//	uint    - uvarint for every record
+//
+// Addresses are split after the last "@" to the local string and the domain dictionary columns.
+// Labels are stored as uint count of pairs and dict column of sorted keys with values of all records.
+// Reason, addresses, IP, private and reserved flags and hash are not stored, they are restored from
+// raw fields. Every Write appends a block, so files are readable after crash up to the last full block,
+// the next Write cuts off the partial one.
+// Columns of a block are at most archiveMaxBlock bytes, larger writes are split to several blocks, so
+// readers reject blocks over the limit as corrupted. Safe for concurrent use.
+type Archive struct {
+	dir    string
+	logger Logger
+	mu     sync.Mutex // serializes writes
+}
+
+const (
+	archiveMagic   = "ORFA"
+	archiveVersion = 1
+	archiveSuffix  = ".orfa"
+	archiveLayout  = "2006-01-02"
+)
+
+// archiveMaxBlock is max size of uncompressed columns of a block
+var archiveMaxBlock = 16 << 20
+
+// archiveMaxFrame returns max size of gzipped block, gzip may expand incompressible data a bit
+func archiveMaxFrame() int64 {
+	return int64(archiveMaxBlock + archiveMaxBlock>>10 + 64)
+}
+
+// archiveColumns lists stored columns in order, see Archive for formats
+var archiveColumns = []struct {
+	name string
+	kind string
+	get  func(rec *archiveRecord) interface{} // *string or *uint64 of the record
+}{
+	{"action", "dict", func(r *archiveRecord) interface{} { return &r.Action }},
+	{"filtering-point", "dict", func(r *archiveRecord) interface{} { return &r.FilteringPoint }},
+	{"raw-action", "dict", func(r *archiveRecord) interface{} { return &r.RawAction }},
+	{"raw-filtering-point", "dict", func(r *archiveRecord) interface{} { return &r.RawFilteringPoint }},
+	{"source", "dict", func(r *archiveRecord) interface{} { return &r.Source }},
+	{"related-ip", "string", func(r *archiveRecord) interface{} { return &r.RelatedIP }},
+	{"sender-local", "string", func(r *archiveRecord) interface{} { return &r.senderLocal }},
+	{"sender-domain", "dict", func(r *archiveRecord) interface{} { return &r.senderDomain }},
+	{"recipient-local", "string", func(r *archiveRecord) interface{} { return &r.recipientLocal }},
+	{"recipient-domain", "dict", func(r *archiveRecord) interface{} { return &r.recipientDomain }},
+	{"message", "string", func(r *archiveRecord) interface{} { return &r.Message }},
+	{"country", "dict", func(r *archiveRecord) interface{} { return &r.Geo.Country }},
+	{"asn", "uint", func(r *archiveRecord) interface{} { return &r.asn }},
+	{"as-org", "dict", func(r *archiveRecord) interface{} { return &r.Geo.ASOrg }},
+	{"label-count", "uint", func(r *archiveRecord) interface{} { return &r.labelCount }},
+}
+
+// archiveRecord is Orf with columns made of its fields
+type archiveRecord struct {
+	Orf
+	senderLocal, senderDomain       string
+	recipientLocal, recipientDomain string
+	asn, labelCount                 uint64
+}
+
+var errArchiveData = errors.New("invalid archive data")
+
+// OpenArchive opens archive in dir, creating dir if needed
+func OpenArchive(dir string) (*Archive, error) {
+	return openArchive(dir, defaultLogger)
+}
+
+// openArchive opens archive logging to logger
+func openArchive(dir string, logger Logger) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Archive{dir: dir, logger: logger}, nil
+}
+
+// Write appends records to partitions of their days
+func (a *Archive) Write(orfs ...Orf) error {
+	days := make(map[string][]Orf)
+	for _, orf := range orfs {
+		day := orf.Time.UTC().Format(archiveLayout)
+		days[day] = append(days[day], orf)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for day, records := range days {
+		if err := a.appendBlock(filepath.Join(a.dir, day+archiveSuffix), records); err != nil {
+			return fmt.Errorf("could not write archive %s: %v", day, err)
+		}
+	}
+	return nil
+}
+
+// Replay sends archived records with time in [from, to] to handler in time order, duplicates are skipped.
+// Replay stops on the first handler error and returns it.
+func (a *Archive) Replay(ctx context.Context, from, to time.Time, handler func(orf Orf) error) error {
+	records, err := a.read(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	for _, orf := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := handler(orf); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Remove deletes partitions of days before from and returns number of removed partitions
+func (a *Archive) Remove(from time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	files, err := a.partitions(time.Time{}, from.Add(-24*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	for i, file := range files {
+		if err := os.Remove(file); err != nil {
+			return i, err
+		}
+	}
+	return len(files), nil
+}
+
+// read returns deduplicated records of [from, to] in time order
+func (a *Archive) read(ctx context.Context, from, to time.Time) ([]Orf, error) {
+	files, err := a.partitions(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Orf, 0)
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err := readArchiveFile(file, from, to, a.logger, func(orf Orf) {
+			if orf.Time.Before(from) || orf.Time.After(to) || seen[orf.HashString] {
+				return
+			}
+			seen[orf.HashString] = true
+			result = append(result, orf)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read archive %s: %v", filepath.Base(file), err)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+// partitions returns files of days overlapping [from, to] in day order
+func (a *Archive) partitions(from, to time.Time) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.dir, "*"+archiveSuffix))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(files))
+	for _, file := range files {
+		day, err := time.Parse(archiveLayout, strings.TrimSuffix(filepath.Base(file), archiveSuffix))
+		if err != nil {
+			continue
+		}
+		if day.After(to) || !day.Add(24*time.Hour).After(from) {
+			continue
+		}
+		result = append(result, file)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// appendBlock writes block of records to the end of file, must be called under lock. Partial block
+// left by a crash is cut off first, otherwise the file would be unreadable after it.
+func (a *Archive) appendBlock(path string, orfs []Orf) error {
+	block, err := encodeArchiveBlock(orfs)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	end, err := archiveCompleteSize(f, info.Size())
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if end < info.Size() {
+		a.logger.Warn("archive truncated block removed", "path", path, "bytes", info.Size()-end)
+		if err = f.Truncate(end); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if end == 0 {
+		block = append([]byte(archiveMagic+string(rune(archiveVersion))), block...)
+	}
+	if _, err = f.WriteAt(block, end); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archiveCompleteSize returns size of archive file up to the end of its last complete block
+func archiveCompleteSize(f *os.File, size int64) (int64, error) {
+	pos := int64(len(archiveMagic) + 1)
+	if size < pos {
+		return 0, nil
+	}
+	frame := make([]byte, 20)
+	for pos+int64(len(frame)) <= size {
+		if _, err := f.ReadAt(frame, pos); err != nil {
+			return 0, err
+		}
+		next := pos + int64(len(frame)) + int64(binary.BigEndian.Uint32(frame))
+		if next > size {
+			break
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// encodeArchiveBlock makes framed block of records, or several blocks if columns are over archiveMaxBlock
+func encodeArchiveBlock(orfs []Orf) ([]byte, error) {
+	records := make([]archiveRecord, len(orfs))
+	minTime, maxTime := orfs[0].Time, orfs[0].Time
+	for i, orf := range orfs {
+		records[i] = newArchiveRecord(orf)
+		if orf.Time.Before(minTime) {
+			minTime = orf.Time
+		}
+		if orf.Time.After(maxTime) {
+			maxTime = orf.Time
+		}
+	}
+
+	var w archiveWriter
+	w.uint(uint64(len(records)))
+	prev := int64(0)
+	for _, r := range records {
+		ns := r.Time.UnixNano()
+		w.int(ns - prev)
+		prev = ns
+	}
+	for _, col := range archiveColumns {
+		values := make([]interface{}, len(records))
+		for i := range records {
+			values[i] = col.get(&records[i])
+		}
+		w.column(col.kind, values)
+	}
+	labels := make([]interface{}, 0)
+	for _, r := range records {
+		keys := make([]string, 0, len(r.Labels))
+		for k := range r.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key, value := k, r.Labels[k]
+			labels = append(labels, &key, &value)
+		}
+	}
+	w.column("dict", labels)
+
+	if w.buf.Len() > archiveMaxBlock {
+		if len(orfs) == 1 {
+			return nil, fmt.Errorf("record %s is too large to archive", orfs[0].HashString)
+		}
+		first, err := encodeArchiveBlock(orfs[:len(orfs)/2])
+		if err != nil {
+			return nil, err
+		}
+		second, err := encodeArchiveBlock(orfs[len(orfs)/2:])
+		if err != nil {
+			return nil, err
+		}
+		return append(first, second...), nil
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(w.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 20, 20+compressed.Len())
+	binary.BigEndian.PutUint32(res, uint32(compressed.Len()))
+	binary.BigEndian.PutUint64(res[4:], uint64(minTime.UnixNano()))
+	binary.BigEndian.PutUint64(res[12:], uint64(maxTime.UnixNano()))
+	return append(res, compressed.Bytes()...), nil
+}
+
+// readArchiveFile decodes blocks with records in [from, to], other blocks are skipped without decompression
+func readArchiveFile(path string, from, to time.Time, logger Logger, fn func(orf Orf)) error {
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(archiveMagic)+1)
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return errArchiveData
+	}
+	if string(magic[:len(archiveMagic)]) != archiveMagic || magic[len(archiveMagic)] != archiveVersion {
+		return errors.New("unsupported archive format")
+	}
+
+	frame := make([]byte, 20)
+	for {
+		if _, err = io.ReadFull(r, frame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			logger.Warn("archive has truncated block", "path", path)
+			return nil
+		}
+		size := int64(binary.BigEndian.Uint32(frame))
+		if size > archiveMaxFrame() {
+			return errArchiveData
+		}
+		minTime := time.Unix(0, int64(binary.BigEndian.Uint64(frame[4:])))
+		maxTime := time.Unix(0, int64(binary.BigEndian.Uint64(frame[12:])))
+		if maxTime.Before(from) || minTime.After(to) {
+			if _, err = io.CopyN(ioutil.Discard, r, size); err != nil {
+				logger.Warn("archive has truncated block", "path", path)
+				return nil
+			}
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			logger.Warn("archive has truncated block", "path", path)
+			return nil
+		}
+		orfs, err := decodeArchiveBlock(data)
+		if err != nil {
+			return err
+		}
+		for _, orf := range orfs {
+			fn(orf)
+		}
+	}
+}
+
+// decodeArchiveBlock decodes gzipped columns of the block
+func decodeArchiveBlock(data []byte) ([]Orf, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(zr, int64(archiveMaxBlock)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > archiveMaxBlock {
+		return nil, errArchiveData
+	}
+
+	rd := archiveReader{buf: raw}
+	count := rd.uint()
+	if rd.err != nil || count > uint64(len(raw)) {
+		return nil, errArchiveData
+	}
+	records := make([]archiveRecord, count)
+	prev := int64(0)
+	for i := range records {
+		prev += rd.int()
+		records[i].Time = time.Unix(0, prev).UTC()
+	}
+	for _, col := range archiveColumns {
+		values := make([]interface{}, len(records))
+		for i := range records {
+			values[i] = col.get(&records[i])
+		}
+		rd.column(col.kind, values)
+	}
+	pairs := uint64(0)
+	for _, r := range records {
+		pairs += r.labelCount
+	}
+	if pairs > uint64(len(raw)) {
+		return nil, errArchiveData
+	}
+	labels := make([]string, 2*pairs)
+	values := make([]interface{}, len(labels))
+	for i := range labels {
+		values[i] = &labels[i]
+	}
+	rd.column("dict", values)
+	if rd.err != nil {
+		return nil, rd.err
+	}
+
+	result := make([]Orf, len(records))
+	for i, r := range records {
+		for j := uint64(0); j < r.labelCount; j++ {
+			r.SetLabel(labels[0], labels[1])
+			labels = labels[2:]
+		}
+		result[i] = r.restore()
+	}
+	return result, nil
+}
+
+func newArchiveRecord(orf Orf) archiveRecord {
+	res := archiveRecord{Orf: orf, asn: uint64(orf.Geo.ASN), labelCount: uint64(len(orf.Labels))}
+	res.senderLocal, res.senderDomain = splitArchiveAddress(orf.Sender)
+	res.recipientLocal, res.recipientDomain = splitArchiveAddress(orf.Recipients)
+	return res
+}
+
+// restore makes Orf with fields not stored in archive
+func (r archiveRecord) restore() Orf {
+	orf := r.Orf
+	orf.Sender = r.senderLocal + r.senderDomain
+	orf.Recipients = r.recipientLocal + r.recipientDomain
+	orf.Reason = ParseReason(orf.Message)
+	orf.SenderAddress = ParseAddress(orf.Sender)
+	orf.RecipientAddress = ParseAddress(orf.Recipients)
+	orf.IP = parseIP(orf.RelatedIP)
+	geo := ipRangeTags(orf.IP)
+	geo.Country, geo.ASN, geo.ASOrg = r.Geo.Country, uint(r.asn), r.Geo.ASOrg
+	orf.Geo = geo
+	orf.Hash()
+	return orf
+}
+
+// splitArchiveAddress splits address after the last "@", domain part is empty without "@"
+func splitArchiveAddress(addr string) (local, domain string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at+1], addr[at+1:]
+}
+
+// archiveWriter encodes columns
+type archiveWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *archiveWriter) uint(v uint64) {
+	w.buf.Write(w.tmp[:binary.PutUvarint(w.tmp[:], v)])
+}
+
+func (w *archiveWriter) int(v int64) {
+	w.buf.Write(w.tmp[:binary.PutVarint(w.tmp[:], v)])
+}
+
+func (w *archiveWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// column writes values, *string for dict and string columns, *uint64 for uint column
+func (w *archiveWriter) column(kind string, values []interface{}) {
+	switch kind {
+	case "dict":
+		dict := make(map[string]uint64)
+		words := make([]string, 0)
+		for _, v := range values {
+			s := *v.(*string)
+			if _, ok := dict[s]; !ok {
+				dict[s] = uint64(len(words))
+				words = append(words, s)
+			}
+		}
+		w.uint(uint64(len(words)))
+		for _, s := range words {
+			w.string(s)
+		}
+		for _, v := range values {
+			w.uint(dict[*v.(*string)])
+		}
+	case "string":
+		for _, v := range values {
+			w.string(*v.(*string))
+		}
+	case "uint":
+		for _, v := range values {
+			w.uint(*v.(*uint64))
+		}
+	}
+}
+
+// archiveReader decodes columns, the first error stops reading
+type archiveReader struct {
+	buf []byte
+	err error
+}
+
+func (r *archiveReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errArchiveData
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *archiveReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errArchiveData
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *archiveReader) string() string {
+	size := r.uint()
+	if r.err != nil {
+		return ""
+	}
+	if size > uint64(len(r.buf)) {
+		r.err = errArchiveData
+		return ""
+	}
+	s := string(r.buf[:size])
+	r.buf = r.buf[size:]
+	return s
+}
+
+// column reads values to pointers, see archiveWriter.column
+func (r *archiveReader) column(kind string, values []interface{}) {
+	switch kind {
+	case "dict":
+		size := r.uint()
+		if size > uint64(len(r.buf)) {
+			r.err = errArchiveData
+		}
+		if r.err != nil {
+			return
+		}
+		words := make([]string, size)
+		for i := range words {
+			words[i] = r.string()
+		}
+		for _, v := range values {
+			idx := r.uint()
+			if r.err != nil {
+				return
+			}
+			if idx >= size {
+				r.err = errArchiveData
+				return
+			}
+			*v.(*string) = words[idx]
+		}
+	case "string":
+		for _, v := range values {
+			*v.(*string) = r.string()
+		}
+	case "uint":
+		for _, v := range values {
+			*v.(*uint64) = r.uint()
+		}
+	}
+}
+
+// archiveRecords writes sent records to the archive
+func (s *Service) archiveRecords(orfs []*Orf) {
+	if s.archive == nil || len(orfs) == 0 {
+		return
+	}
+	records := make([]Orf, 0, len(orfs))
+	for _, orf := range orfs {
+		records = append(records, *orf)
+	}
+	if err := s.archive.Write(records...); err != nil {
+		s.Logger.Warn("could not archive records", "records", len(records), "error", err)
+	}
+}
@@ -0,0 +1,186 @@
+package orflog
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	day := func(d, h int) time.Time { return time.Date(2026, 3, d, h, 0, 0, 0, time.UTC) }
+	record := func(t time.Time, sender, recipient string) Orf {
+		orf := Orf{Time: t, Action: ifReject("Reject"), FilteringPoint: filterPoint("BeforeArrival"), RawAction: "Reject",
+			RawFilteringPoint: "BeforeArrival", RelatedIP: "95.108.1.1", Sender: sender, Recipients: recipient,
+			Message: "DNSBL (zen.spamhaus.org) listed ", Source: "mx1"}
+		orf.IP = parseIP(orf.RelatedIP)
+		orf.Geo = Geo{Country: "RU", ASN: 13238, ASOrg: "YANDEX LLC"}
+		orf.Reason = ParseReason(orf.Message)
+		orf.SenderAddress, orf.RecipientAddress = ParseAddress(sender), ParseAddress(recipient)
+		orf.Hash()
+		return orf
+	}
+	first := record(day(1, 10), "<a@Example.COM>", "b@пример.рф")
+	first.SetLabel("department", "sales")
+	first.SetLabel("vip", "yes")
+	second := record(day(1, 12), "<>", "postmaster")
+	third := record(day(2, 9), "c@example.com", "d@example.com")
+
+	a, err := OpenArchive(filepath.Join(dir, "archive"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, a.Write(second, third))
+	assert.NoError(t, a.Write(first, third))
+
+	var got []Orf
+	err = a.Replay(context.Background(), day(1, 0), day(3, 0), func(orf Orf) error {
+		got = append(got, orf)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Orf{first, second, third}, got, "restored in time order without duplicates")
+
+	got = nil
+	assert.NoError(t, a.Replay(context.Background(), day(1, 11), day(1, 23), func(orf Orf) error {
+		got = append(got, orf)
+		return nil
+	}))
+	assert.Equal(t, []Orf{second}, got)
+
+	// truncated block is skipped
+	path := filepath.Join(dir, "archive", "2026-03-02.orfa")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte{0, 0, 1})
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	got = nil
+	assert.NoError(t, a.Replay(context.Background(), day(2, 0), day(3, 0), func(orf Orf) error {
+		got = append(got, orf)
+		return nil
+	}))
+	assert.Equal(t, []Orf{third}, got)
+
+	removed, err := a.Remove(day(2, 5))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	files, _ := filepath.Glob(filepath.Join(dir, "archive", "*"))
+	assert.Equal(t, []string{path}, files)
+}
+
+func TestArchive_crashAppend(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	a, err := OpenArchive(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	record := func(h int, sender string) Orf {
+		orf := Orf{Time: day.Add(time.Duration(h) * time.Hour), Sender: sender}
+		orf.Hash()
+		return orf
+	}
+	assert.NoError(t, a.Write(record(1, "first")))
+	assert.NoError(t, a.Write(record(2, "lost")))
+
+	// crash in the middle of the second block
+	path := filepath.Join(dir, "2026-03-01.orfa")
+	info, err := os.Stat(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, os.Truncate(path, info.Size()-5))
+	assert.NoError(t, a.Write(record(3, "last")))
+
+	var got []string
+	assert.NoError(t, a.Replay(context.Background(), day, day.Add(24*time.Hour), func(orf Orf) error {
+		got = append(got, orf.Sender)
+		return nil
+	}))
+	assert.Equal(t, []string{"first", "last"}, got)
+
+	// crash while writing the magic of a new file
+	path = filepath.Join(dir, "2026-03-02.orfa")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(archiveMagic[:2]), 0600))
+	assert.NoError(t, a.Write(record(25, "next")))
+	got = nil
+	assert.NoError(t, a.Replay(context.Background(), day.Add(24*time.Hour), day.Add(48*time.Hour), func(orf Orf) error {
+		got = append(got, orf.Sender)
+		return nil
+	}))
+	assert.Equal(t, []string{"next"}, got)
+}
+
+func TestArchive_blockSize(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	a, err := OpenArchive(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	defer func(size int) { archiveMaxBlock = size }(archiveMaxBlock)
+	archiveMaxBlock = 1 << 10
+
+	// write over the block limit is split
+	big := strings.Repeat("x", archiveMaxBlock/3+1)
+	var orfs []Orf
+	for i := 0; i < 3; i++ {
+		orfs = append(orfs, Orf{Time: start.Add(time.Duration(i) * time.Minute), Message: big, HashString: fmt.Sprint(i)})
+	}
+	assert.NoError(t, a.Write(orfs...))
+	blocks := 0
+	assert.NoError(t, readArchiveFile(filepath.Join(dir, "2026-03-01.orfa"), start, start, NopLogger, func(Orf) { blocks++ }))
+	assert.Equal(t, 1, blocks, "only the block of the first record is read")
+	var got []Orf
+	assert.NoError(t, a.Replay(context.Background(), start, start.Add(time.Hour), func(orf Orf) error {
+		got = append(got, orf)
+		return nil
+	}))
+	assert.Equal(t, 3, len(got))
+	assert.Error(t, a.Write(Orf{Time: start, Message: big + big + big}), "record over the limit")
+
+	// oversized frame is rejected without allocation
+	frame := make([]byte, 20)
+	binary.BigEndian.PutUint32(frame, 0xfffffff0)
+	binary.BigEndian.PutUint64(frame[12:], uint64(start.UnixNano()))
+	path := filepath.Join(dir, "2026-03-02.orfa")
+	assert.NoError(t, ioutil.WriteFile(path, append([]byte(archiveMagic+string(rune(archiveVersion))), frame...), 0600))
+	assert.Equal(t, errArchiveData, readArchiveFile(path, start, start, NopLogger, func(Orf) {}))
+}
+
+func TestService_ReplayArchive(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	logs := filepath.Join(dir, "logs")
+	assert.NoError(t, os.Mkdir(logs, 0700))
+	now := time.Now().UTC().Truncate(time.Second)
+	writeLog(t, logs, "orf.log", orfLogLine(now.Add(-time.Hour), "archived@sender.com"))
+
+	svc := NewService(Opts{LogPaths: []string{logs}, TimeZone: "UTC", ArchiveDir: filepath.Join(dir, "archive")})
+	assert.Equal(t, 1, len(svc.GetLastRecords()))
+	assert.NoError(t, os.Remove(filepath.Join(logs, "orf.log")))
+
+	var senders []string
+	err := svc.Replay(context.Background(), now.Add(-2*time.Hour), now, func(orf Orf) error {
+		senders = append(senders, orf.Sender)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"archived@sender.com"}, senders)
+}
@@ -0,0 +1,190 @@
+package orflog
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batch collects records of one source found by one scan cycle
+type Batch struct {
+	Cycle   uint64 // number of scan cycle, starts from 1
+	Source  string
+	Records []Orf
+}
+
+// BatchOpts defines limits of batches
+type BatchOpts struct {
+	MaxSize    int           // max records in batch, 100 by default
+	MaxLatency time.Duration // max time the first record waits in batch, 1s by default
+	Buffer     int           // batches buffered in channel
+}
+
+const (
+	batchMaxSize    = 100
+	batchMaxLatency = time.Second
+)
+
+// batchItem is a record for batcher or, with flush set, the end of scan cycle
+type batchItem struct {
+	cycle uint64
+	orf   Orf
+	flush bool
+}
+
+// batcher groups records by cycle and source and sends them as batches
+type batcher struct {
+	filter Filter
+	opts   BatchOpts
+	in     chan batchItem
+	ch     chan Batch
+	done   chan struct{}
+	once   sync.Once
+}
+
+// pendingBatch is a batch being collected with the timer started by its first record
+type pendingBatch struct {
+	Batch
+	timer *time.Timer
+}
+
+// SubscribeBatches returns channel with batches of new records matching filter. Batch is sent when it has
+// opts.MaxSize records, its first record waits opts.MaxLatency or the scan cycle ends, so a batch never mixes
+// records of different cycles or sources. Slow consumer blocks delivery as OverflowBlock subscriber does.
+// Returned func cancels subscription and closes the channel, see Subscribe about Channel().
+func (s *Service) SubscribeBatches(filter Filter, opts BatchOpts) (<-chan Batch, func()) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = batchMaxSize
+	}
+	if opts.MaxLatency <= 0 {
+		opts.MaxLatency = batchMaxLatency
+	}
+	if opts.Buffer < 0 {
+		opts.Buffer = 0
+	}
+	b := &batcher{
+		filter: filter,
+		opts:   opts,
+		in:     make(chan batchItem),
+		ch:     make(chan Batch, opts.Buffer),
+		done:   make(chan struct{}),
+	}
+
+	s.subs.Lock()
+	if s.subs.closed {
+		s.subs.Unlock()
+		close(b.ch)
+		return b.ch, func() {}
+	}
+	s.subs.batchers = append(s.subs.batchers, b)
+	s.subs.Unlock()
+
+	go b.run()
+
+	cancel := func() {
+		s.subs.Lock()
+		s.subs.batchers = removeBatcher(s.subs.batchers, b)
+		s.subs.Unlock()
+		b.stop()
+	}
+	return b.ch, cancel
+}
+
+// flushBatches sends batches of the finished cycle
+func (s *Service) flushBatches(ctx context.Context, cycle uint64) {
+	for _, b := range s.batchers() {
+		b.add(ctx, batchItem{cycle: cycle, flush: true})
+	}
+}
+
+func (s *Service) batchers() []*batcher {
+	s.subs.RLock()
+	defer s.subs.RUnlock()
+	list := make([]*batcher, len(s.subs.batchers))
+	copy(list, s.subs.batchers)
+	return list
+}
+
+// add passes item to batcher goroutine
+func (b *batcher) add(ctx context.Context, item batchItem) {
+	if !item.flush && b.filter != nil && !b.filter(item.orf) {
+		return
+	}
+	select {
+	case b.in <- item:
+	case <-b.done:
+	case <-ctx.Done():
+	}
+}
+
+// run collects batches until batcher stopped, the only sender to b.ch
+func (b *batcher) run() {
+	defer close(b.ch)
+
+	pending := make(map[string]*pendingBatch)
+	expired := make(chan *pendingBatch)
+	send := func(source string) bool {
+		p := pending[source]
+		delete(pending, source)
+		p.timer.Stop()
+		select {
+		case b.ch <- p.Batch:
+			return true
+		case <-b.done:
+			return false
+		}
+	}
+
+	for {
+		select {
+		case item := <-b.in:
+			if item.flush {
+				for source, p := range pending {
+					if p.Cycle <= item.cycle && !send(source) {
+						return
+					}
+				}
+				continue
+			}
+			source := item.orf.Source
+			if p, ok := pending[source]; ok && p.Cycle != item.cycle && !send(source) {
+				return
+			}
+			p, ok := pending[source]
+			if !ok {
+				p = &pendingBatch{Batch: Batch{Cycle: item.cycle, Source: source}}
+				p.timer = time.AfterFunc(b.opts.MaxLatency, func() {
+					select {
+					case expired <- p:
+					case <-b.done:
+					}
+				})
+				pending[source] = p
+			}
+			p.Records = append(p.Records, item.orf)
+			if len(p.Records) >= b.opts.MaxSize && !send(source) {
+				return
+			}
+		case p := <-expired:
+			// the batch could be sent already while its timer was firing
+			if pending[p.Source] == p && !send(p.Source) {
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *batcher) stop() {
+	b.once.Do(func() { close(b.done) })
+}
+
+func removeBatcher(list []*batcher, b *batcher) []*batcher {
+	for i, item := range list {
+		if item == b {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
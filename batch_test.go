@@ -0,0 +1,71 @@
+package orflog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_SubscribeBatches(t *testing.T) {
+	svc := NewService(Opts{NoChannel: true})
+	ch, cancel := svc.SubscribeBatches(nil, BatchOpts{MaxSize: 2, MaxLatency: time.Hour, Buffer: 10})
+	defer cancel()
+
+	ctx := context.Background()
+	svc.publish(ctx, 1, Orf{Source: "orf01", Sender: "1"})
+	svc.publish(ctx, 1, Orf{Source: "orf02", Sender: "2"})
+	svc.publish(ctx, 1, Orf{Source: "orf01", Sender: "3"})
+	svc.publish(ctx, 1, Orf{Source: "orf01", Sender: "4"})
+	svc.flushBatches(ctx, 1)
+	svc.publish(ctx, 2, Orf{Source: "orf01", Sender: "5"})
+	svc.flushBatches(ctx, 2)
+
+	senders := func(b Batch) (res []string) {
+		for _, orf := range b.Records {
+			res = append(res, orf.Sender)
+		}
+		return res
+	}
+
+	b := <-ch
+	assert.Equal(t, uint64(1), b.Cycle)
+	assert.Equal(t, "orf01", b.Source)
+	assert.Equal(t, []string{"1", "3"}, senders(b), "full batch")
+
+	flushed := map[string][]string{}
+	for i := 0; i < 2; i++ {
+		b = <-ch
+		assert.Equal(t, uint64(1), b.Cycle)
+		flushed[b.Source] = senders(b)
+	}
+	assert.Equal(t, map[string][]string{"orf01": {"4"}, "orf02": {"2"}}, flushed, "flushed by the end of cycle")
+
+	b = <-ch
+	assert.Equal(t, Batch{Cycle: 2, Source: "orf01", Records: []Orf{{Source: "orf01", Sender: "5"}}}, b)
+}
+
+func TestService_SubscribeBatchesLatency(t *testing.T) {
+	svc := NewService(Opts{NoChannel: true})
+	ch, cancel := svc.SubscribeBatches(func(orf Orf) bool { return orf.Sender != "skip" }, BatchOpts{MaxLatency: 400 * time.Millisecond})
+
+	svc.publish(context.Background(), 1, Orf{Sender: "skip"})
+	start := time.Now()
+	svc.publish(context.Background(), 1, Orf{Sender: "1"})
+
+	select {
+	case b := <-ch:
+		elapsed := time.Since(start)
+		assert.True(t, elapsed >= 400*time.Millisecond, "sent before MaxLatency, %v", elapsed)
+		assert.True(t, elapsed < 500*time.Millisecond, "sent too late after MaxLatency, %v", elapsed)
+		assert.Equal(t, 1, len(b.Records))
+		assert.Equal(t, "1", b.Records[0].Sender)
+	case <-time.After(2 * time.Second):
+		t.Fatal("batch is not sent by latency")
+	}
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
@@ -0,0 +1,535 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadConfig reads Opts from TOML (.toml) or JSON (.json) file. Keys are long names of flags, groups
+// are tables named by their namespace, Sources and Rules are arrays of tables with kebab-case keys:
+//
+//	log-paths = ["//orf1/logs"]
+//	sleep-time = "30s"
+//	[dedup]
+//	max-entries = 100000
+//	[[sources]]
+//	path = "//orf2/logs"
+//	time-zone = "Europe/Moscow"
+//	[[rules.exclude]]
+//	sender = "*@example.com"
+//
+// Options missing in the file get defaults of flags. Unknown keys, wrong types and problems found by
+// Validate are errors, all of them are reported at once.
+func LoadConfig(path string) (Opts, error) {
+	var opts Opts
+	data, err := ioutil.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return opts, err
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		doc, err = parseTOML(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+	default:
+		return opts, fmt.Errorf("unsupported config format %q of %s, .toml or .json expected", ext, path)
+	}
+	if err != nil {
+		return opts, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+
+	v := reflect.ValueOf(&opts).Elem()
+	if err = configDefaults(v); err != nil {
+		return opts, err
+	}
+	set := make(map[string]bool)
+	problems := decodeConfigStruct(v, doc, "", set)
+	if set["retention"] && (set["time-range.years"] || set["time-range.months"] || set["time-range.days"]) {
+		problems = append(problems, "retention overrides time-range, set only one of them")
+	}
+	if err = opts.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return opts, fmt.Errorf("invalid config %s: %s", path, strings.Join(problems, "; "))
+	}
+	return opts, nil
+}
+
+// Validate checks that log paths are existing directories and that intervals, time range, encodings,
+// time zones and rules are valid, every problem is reported
+func (o Opts) Validate() error {
+	var problems []string
+	if len(o.LogPaths) == 0 && len(o.Sources) == 0 {
+		problems = append(problems, "no log paths, set log-paths or sources")
+	}
+	for _, path := range o.LogPaths {
+		if err := checkLogDir(path); err != nil {
+			problems = append(problems, "log-paths: "+err.Error())
+		}
+	}
+	for i, src := range o.Sources {
+		if src.Path == "" {
+			problems = append(problems, fmt.Sprintf("sources[%d]: path is not set", i))
+		} else if err := checkLogDir(src.Path); err != nil {
+			problems = append(problems, fmt.Sprintf("sources[%d]: %v", i, err))
+		}
+		if src.Encoding != "" && !validEncoding(src.Encoding) {
+			problems = append(problems, fmt.Sprintf("sources[%d]: unsupported encoding %q", i, src.Encoding))
+		}
+		if _, err := loadLocation(src.TimeZone); src.TimeZone != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("sources[%d]: %v", i, err))
+		}
+	}
+
+	if o.Encoding != "" && !validEncoding(o.Encoding) {
+		problems = append(problems, fmt.Sprintf("encoding: unsupported encoding %q", o.Encoding))
+	}
+	if _, err := loadLocation(o.TimeZone); err != nil {
+		problems = append(problems, "time-zone: "+err.Error())
+	}
+	if o.SleepTime < time.Second {
+		problems = append(problems, fmt.Sprintf("sleep-time: must be at least 1s, got %v", o.SleepTime))
+	}
+	if o.SourceTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("source-timeout: must be positive, got %v", o.SourceTimeout))
+	}
+	if o.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("workers: must be at least 1, got %d", o.Workers))
+	}
+	if o.Retention < 0 {
+		problems = append(problems, fmt.Sprintf("retention: must not be negative, got %v", o.Retention))
+	}
+	if o.Backfill < 0 {
+		problems = append(problems, fmt.Sprintf("backfill: must not be negative, got %v", o.Backfill))
+	}
+	tr := o.TimeRange
+	switch {
+	case tr.Years < 0 || tr.Months < 0 || tr.Days < 0:
+		problems = append(problems, fmt.Sprintf("time-range: must not be negative, got %d years %d months %d days", tr.Years, tr.Months, tr.Days))
+	case o.Retention == 0 && tr.Years == 0 && tr.Months == 0 && tr.Days == 0:
+		problems = append(problems, "time-range: empty, set years, months, days or retention")
+	}
+	if o.Dedup.Bucket < 0 || o.Dedup.MaxEntries < 0 {
+		problems = append(problems, "dedup: bucket and max-entries must not be negative")
+	}
+	if o.Dedup.Probabilistic && (o.Dedup.FalsePositiveRate <= 0 || o.Dedup.FalsePositiveRate >= 1) {
+		problems = append(problems, fmt.Sprintf("dedup: false-positive-rate must be in (0, 1), got %v", o.Dedup.FalsePositiveRate))
+	}
+	for _, db := range []string{o.GeoIP.CountryDB, o.GeoIP.ASNDB} {
+		if _, err := os.Stat(db); db != "" && err != nil {
+			problems = append(problems, "geoip: "+err.Error())
+		}
+	}
+	for i, r := range o.Rules.Include {
+		if _, err := compileRule(r); err != nil {
+			problems = append(problems, fmt.Sprintf("rules.include[%d]: %v", i, err))
+		}
+	}
+	for i, r := range o.Rules.Exclude {
+		if _, err := compileRule(r); err != nil {
+			problems = append(problems, fmt.Sprintf("rules.exclude[%d]: %v", i, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkLogDir checks that log path is an existing directory
+func checkLogDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", path)
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// Reload applies log paths, sources, encodings, time zones, rules, retention and scan settings of opts
+// to the running service, defaults are set as by NewService. Dedup state, subscribers and the window
+// are kept, so records of kept sources are not sent again, while new sources send their records from
+// the window. Dedup, geoip, index and archive settings need restart, their changes are ignored with warning.
+func (s *Service) Reload(opts Opts) {
+	next := &Service{Opts: opts}
+	next.Logger = s.Logger
+	next.setDefaults()
+	next.sources = next.makeSources()
+
+	for _, opt := range []struct {
+		name    string
+		changed bool
+	}{
+		{"dedup", opts.Dedup != s.Dedup},
+		{"geoip", opts.GeoIP != s.GeoIP},
+		{"index-dir", opts.IndexDir != s.IndexDir},
+		{"archive-dir", opts.ArchiveDir != s.ArchiveDir},
+	} {
+		if opt.changed {
+			s.Logger.Warn("change of option ignored, restart needed", "option", opt.name)
+		}
+	}
+
+	s.cfgMu.Lock()
+	s.mu.Lock()
+	s.LogPaths, s.Sources, s.LogSuffix, s.OrfLine = next.LogPaths, next.Sources, next.LogSuffix, next.OrfLine
+	s.Encoding, s.TimeZone, s.Rules = next.Encoding, next.TimeZone, next.Rules
+	s.SleepTime, s.Workers, s.SourceTimeout = next.SleepTime, next.Workers, next.SourceTimeout
+	s.Retention, s.Backfill, s.TimeRange = next.Retention, next.Backfill, next.TimeRange
+	s.sources = next.sources
+	s.rules = compileRules(next.Rules, s.Logger)
+	s.mu.Unlock()
+	// scans report reachability by index of source, health list is replaced before they see new sources
+	s.health.setSources(next.sources)
+	s.cfgMu.Unlock()
+
+	s.read.reset() // encodings, time zones and rules may change records of read files
+	names := make([]string, 0, len(next.sources))
+	for _, src := range next.sources {
+		names = append(names, src.Name)
+	}
+	s.Logger.Info("configuration reloaded", "sources", strings.Join(names, ","))
+}
+
+// ReloadConfig loads config file and applies it with Reload, running service is left as is if the file is invalid
+func (s *Service) ReloadConfig(path string) error {
+	opts, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	s.Reload(opts)
+	return nil
+}
+
+// WatchConfig reloads config file on SIGHUP and when its modification time or size changed, checked
+// every interval (file is not polled if interval is not positive), until ctx is done. Invalid config
+// is logged and the service keeps running with the previous one.
+func (s *Service) WatchConfig(ctx context.Context, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	stamp := func() string {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size())
+	}
+	last := stamp()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last = stamp()
+		case <-tick:
+			st := stamp()
+			if st == last || st == "" {
+				continue
+			}
+			last = st
+		}
+		if err := s.ReloadConfig(path); err != nil {
+			s.Logger.Error("could not reload config, previous one kept", "path", path, "error", err)
+		}
+	}
+}
+
+// configKey returns key of the field in config: namespace of group, long name of flag or kebab-case name
+func configKey(f reflect.StructField) string {
+	if ns := f.Tag.Get("namespace"); ns != "" {
+		return ns
+	}
+	if long := f.Tag.Get("long"); long != "" {
+		return long
+	}
+	var b strings.Builder
+	runes := []rune(f.Name)
+	for i, r := range runes {
+		// word starts at upper case letter after lower case one or before lower case one in acronym, IPRange
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// configurable checks if values of type can be set from config, funcs, interfaces and pointers can't
+func configurable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Func, reflect.Interface, reflect.Ptr, reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Slice, reflect.Array:
+		return configurable(t.Elem())
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && configurable(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && !configurable(f.Type) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// configFields returns configurable exported fields of struct by config key
+func configFields(v reflect.Value) map[string]reflect.Value {
+	res := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || !configurable(f.Type) {
+			continue
+		}
+		res[configKey(f)] = v.Field(i)
+	}
+	return res
+}
+
+// configDefaults sets fields to values of default tags
+func configDefaults(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if err := configDefaults(v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		def, ok := f.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		if p := decodeConfigValue(v.Field(i), def, f.Name); len(p) > 0 {
+			return fmt.Errorf("invalid default: %s", p[0])
+		}
+	}
+	return nil
+}
+
+// decodeConfigStruct sets fields of struct v from table, keys set are collected with prefix
+func decodeConfigStruct(v reflect.Value, table map[string]interface{}, prefix string, set map[string]bool) []string {
+	fields := configFields(v)
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, k := range keys {
+		field, ok := fields[k]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown key %s%s", prefix, k))
+			continue
+		}
+		set[prefix+k] = true
+		if field.Kind() == reflect.Struct && field.Type() != durationType {
+			sub, ok := table[k].(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s%s: table expected, got %s", prefix, k, configType(table[k])))
+				continue
+			}
+			problems = append(problems, decodeConfigStruct(field, sub, prefix+k+".", set)...)
+			continue
+		}
+		problems = append(problems, decodeConfigValue(field, table[k], prefix+k)...)
+	}
+	return problems
+}
+
+// decodeConfigValue sets v from parsed value, strings are parsed for numbers, bools and durations
+func decodeConfigValue(v reflect.Value, raw interface{}, key string) []string {
+	problem := func(format string, args ...interface{}) []string {
+		return []string{key + ": " + fmt.Sprintf(format, args...)}
+	}
+	mismatch := func(expected string) []string {
+		return problem("%s expected, got %s", expected, configType(raw))
+	}
+
+	if v.Type() == durationType {
+		s, ok := raw.(string)
+		if !ok {
+			return mismatch(`duration string like "1m30s"`)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return problem("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return mismatch("string")
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		switch b := raw.(type) {
+		case bool:
+			v.SetBool(b)
+		case string:
+			parsed, err := strconv.ParseBool(b)
+			if err != nil {
+				return mismatch("boolean")
+			}
+			v.SetBool(parsed)
+		default:
+			return mismatch("boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var s string
+		switch n := raw.(type) {
+		case int64:
+			s = strconv.FormatInt(n, 10)
+		case json.Number:
+			s = n.String()
+		case string:
+			s = n
+		default:
+			return mismatch("integer")
+		}
+		if v.Kind() >= reflect.Uint {
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil || v.OverflowUint(n) {
+				return problem("invalid unsigned integer %s", s)
+			}
+			v.SetUint(n)
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return problem("invalid integer %s", s)
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		var err error
+		switch n := raw.(type) {
+		case float64:
+			f = n
+		case int64:
+			f = float64(n)
+		case json.Number:
+			f, err = n.Float64()
+		case string:
+			f, err = strconv.ParseFloat(n, 64)
+		default:
+			return mismatch("number")
+		}
+		if err != nil {
+			return problem("invalid number %v", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return mismatch("array")
+		}
+		res := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+		var problems []string
+		for i, item := range arr {
+			problems = append(problems, decodeConfigItem(res.Index(i), item, fmt.Sprintf("%s[%d]", key, i))...)
+		}
+		v.Set(res)
+		return problems
+	case reflect.Map:
+		table, ok := raw.(map[string]interface{})
+		if !ok {
+			return mismatch("table")
+		}
+		res := reflect.MakeMapWithSize(v.Type(), len(table))
+		var problems []string
+		for k, item := range table {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			problems = append(problems, decodeConfigItem(elem, item, key+"."+k)...)
+			res.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+		}
+		v.Set(res)
+		sort.Strings(problems)
+		return problems
+	default:
+		return problem("unsupported option type %s", v.Type())
+	}
+	return nil
+}
+
+// decodeConfigItem sets element of array or map, structs are tables
+func decodeConfigItem(v reflect.Value, raw interface{}, key string) []string {
+	if v.Kind() != reflect.Struct || v.Type() == durationType {
+		return decodeConfigValue(v, raw, key)
+	}
+	table, ok := raw.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: table expected, got %s", key, configType(raw))}
+	}
+	return decodeConfigStruct(v, table, key+".", make(map[string]bool))
+}
+
+// configType names type of parsed value for errors
+func configType(raw interface{}) string {
+	switch raw.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "table"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", raw)
+	}
+}
@@ -0,0 +1,251 @@
+package orflog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.NoError(t, os.Mkdir(logs, 0700))
+
+	expected := Opts{
+		LogPaths:      []string{logs},
+		LogSuffix:     ".txt",
+		Encoding:      "auto",
+		TimeZone:      "+03:00",
+		OrfLine:       "SMTPSVC",
+		SleepTime:     30 * time.Second,
+		Retention:     48 * time.Hour,
+		Workers:       4,
+		SourceTimeout: 30 * time.Second,
+		Sources:       []Source{{Path: "./test", Name: "orf2", Encoding: "utf-16le"}},
+		Dedup:         DedupOpts{MaxEntries: 1000, Bucket: time.Hour, FalsePositiveRate: 0.001, BloomCapacity: 100000},
+		Rules:         Rules{Exclude: []Rule{{Sender: "*@spam.example.com"}, {FilteringPoint: "OnArrival", IPRange: "10.0.0.0/8"}}},
+	}
+	expected.TimeRange.Months = 1
+
+	writeLog(t, dir, "orflog.toml", `
+log-paths = ['`+logs+`']
+log-suffix = ".txt"
+time-zone = "+03:00"
+sleep-time = "30s"
+retention = "48h"
+
+[dedup]
+max-entries = 1000
+
+[[sources]]
+path = "./test"
+name = "orf2"
+encoding = "utf-16le"
+
+[[rules.exclude]]
+sender = "*@spam.example.com"
+[[rules.exclude]]
+filtering-point = "OnArrival"
+ip-range = "10.0.0.0/8"
+`)
+	opts, err := LoadConfig(filepath.Join(dir, "orflog.toml"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, opts)
+
+	writeLog(t, dir, "orflog.json", `{
+  "log-paths": ["`+filepath.ToSlash(logs)+`"],
+  "log-suffix": ".txt",
+  "time-zone": "+03:00",
+  "sleep-time": "30s",
+  "retention": "48h",
+  "dedup": {"max-entries": 1000},
+  "sources": [{"path": "./test", "name": "orf2", "encoding": "utf-16le"}],
+  "rules": {"exclude": [{"sender": "*@spam.example.com"}, {"filtering-point": "OnArrival", "ip-range": "10.0.0.0/8"}]}
+}`)
+	expected.LogPaths = []string{filepath.ToSlash(logs)}
+	opts, err = LoadConfig(filepath.Join(dir, "orflog.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, opts)
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+
+	writeLog(t, dir, "invalid.toml", `
+log-paths = ['`+missing+`', "./test/test.log"]
+sleep-time = "0s"
+workers = "many"
+retention = "24h"
+logger = "stdout"
+stages = []
+
+[time-range]
+days = 7
+
+[dedup]
+bucket = 3600
+max-entrys = 10
+
+[[sources]]
+name = "no path"
+time-zone = "Mars/Olympus"
+
+[[rules.include]]
+ip-range = "10.0.0.0/33"
+`)
+	_, err := LoadConfig(filepath.Join(dir, "invalid.toml"))
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Equal(t, "invalid config "+filepath.Join(dir, "invalid.toml")+": "+strings.Join([]string{
+		`dedup.bucket: duration string like "1m30s" expected, got integer`,
+		"unknown key dedup.max-entrys",
+		"unknown key logger",
+		"unknown key stages",
+		"workers: invalid integer many",
+		"retention overrides time-range, set only one of them",
+		"log-paths: " + missing + " does not exist",
+		"log-paths: ./test/test.log is not a directory",
+		"sources[0]: path is not set",
+		`sources[0]: invalid time zone "Mars/Olympus": unknown time zone Mars/Olympus`,
+		"sleep-time: must be at least 1s, got 0s",
+		"rules.include[0]: invalid CIDR address: 10.0.0.0/33",
+	}, "; "), err.Error())
+
+	writeLog(t, dir, "broken.toml", "log-paths = [\"./test\"\n")
+	_, err = LoadConfig(filepath.Join(dir, "broken.toml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not parse config "+filepath.Join(dir, "broken.toml")+": Near line 1")
+	}
+
+	writeLog(t, dir, "empty-array.toml", "sources = []\n[sources]\nname = \"a\"\n")
+	_, err = LoadConfig(filepath.Join(dir, "empty-array.toml"))
+	assert.EqualError(t, err, "could not parse config "+filepath.Join(dir, "empty-array.toml")+
+		": Near line 2 (last key parsed ''): Key 'sources' has already been defined.")
+
+	writeLog(t, dir, "orflog.yaml", "log-paths: [./test]")
+	_, err = LoadConfig(filepath.Join(dir, "orflog.yaml"))
+	assert.EqualError(t, err, `unsupported config format ".yaml" of `+filepath.Join(dir, "orflog.yaml")+", .toml or .json expected")
+
+	_, err = LoadConfig(missing + ".toml")
+	assert.Error(t, err)
+}
+
+func TestOpts_Validate(t *testing.T) {
+	opts := Opts{LogPaths: []string{"./test"}, SleepTime: time.Minute, SourceTimeout: time.Second, Workers: 1, Retention: time.Hour}
+	assert.NoError(t, opts.Validate())
+
+	opts.Retention = 0
+	opts.TimeRange.Days = -1
+	opts.Encoding = "koi8-r"
+	assert.EqualError(t, opts.Validate(), `encoding: unsupported encoding "koi8-r"; time-range: must not be negative, got 0 years 0 months -1 days`)
+
+	assert.EqualError(t, Opts{TimeZone: "Local", SleepTime: time.Minute, SourceTimeout: time.Second, Workers: 1}.Validate(),
+		"no log paths, set log-paths or sources; time-range: empty, set years, months, days or retention")
+}
+
+func TestService_Reload(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	dir1, dir2 := filepath.Join(dir, "one"), filepath.Join(dir, "two")
+	assert.NoError(t, os.Mkdir(dir1, 0700))
+	assert.NoError(t, os.Mkdir(dir2, 0700))
+	now := time.Now().Truncate(time.Second)
+	writeLog(t, dir1, "a.log", orfLogLine(now.Add(-time.Hour), "one@example.com"))
+	writeLog(t, dir2, "b.log", orfLogLine(now.Add(-time.Hour), "two@example.com"))
+
+	rec := &recordingLogger{}
+	svc := NewService(Opts{LogPaths: []string{dir1}, Retention: 24 * time.Hour, Logger: rec})
+	assert.Equal(t, 1, len(svc.GetLastRecords()))
+
+	svc.Reload(Opts{LogPaths: []string{dir1, dir2}, Retention: 24 * time.Hour, SleepTime: time.Hour, IndexDir: dir})
+	assert.Equal(t, time.Hour, svc.sleepTime())
+	orfs := svc.GetLastRecords()
+	if assert.Equal(t, 1, len(orfs), "records of the new source only, dedup kept") {
+		assert.Equal(t, "two@example.com", orfs[0].Sender)
+		assert.Equal(t, dir2, orfs[0].Source)
+	}
+	st := svc.Status()
+	if assert.Equal(t, 2, len(st.Sources)) {
+		assert.True(t, st.Sources[0].Reachable, "status of kept source")
+		assert.Equal(t, dir1, st.Sources[0].Name)
+	}
+
+	// removed source is not scanned, its records are not forgotten
+	svc.Reload(Opts{LogPaths: []string{dir2}, Retention: 24 * time.Hour, Rules: Rules{Exclude: []Rule{{Sender: "three@*"}}}})
+	writeLog(t, dir1, "a.log", orfLogLine(now.Add(-time.Hour), "one@example.com")+"\n"+orfLogLine(now, "new@example.com"))
+	writeLog(t, dir2, "b.log", orfLogLine(now.Add(-time.Hour), "two@example.com")+"\n"+orfLogLine(now, "three@example.com"))
+	assert.Equal(t, 0, len(svc.GetLastRecords()))
+	st = svc.Status()
+	assert.Equal(t, 1, len(st.Sources))
+	for _, f := range st.Files {
+		assert.Equal(t, dir2, f.Source)
+	}
+
+	assert.Contains(t, rec.lines, "WARN change of option ignored, restart needed [option index-dir]")
+	assert.Contains(t, rec.lines, "INFO configuration reloaded [sources "+dir1+","+dir2+"]")
+}
+
+func TestService_WatchConfig(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "orflog.toml")
+	writeLog(t, dir, "orflog.toml", `log-paths = ["./test"]`)
+	opts, err := LoadConfig(cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rec := &recordingLogger{}
+	opts.Logger = rec
+	svc := NewService(opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.WatchConfig(ctx, cfg, 10*time.Millisecond)
+		close(done)
+	}()
+	sources := func() []string {
+		svc.cfgMu.RLock()
+		defer svc.cfgMu.RUnlock()
+		res := make([]string, 0, len(svc.sources))
+		for _, src := range svc.sources {
+			res = append(res, src.Name)
+		}
+		return res
+	}
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 200; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	time.Sleep(50 * time.Millisecond) // watcher remembers the file
+	writeLog(t, dir, "orflog.toml", "log-paths = [\"./test\"]\nsleep-time = \"1s\"\n\n[[sources]]\npath = \""+filepath.ToSlash(dir)+"\"\nname = \"second\"\n")
+	assert.True(t, waitFor(func() bool { return len(sources()) == 2 }), "reloaded")
+	assert.Equal(t, []string{"second", "./test"}, sources())
+	assert.Equal(t, time.Second, svc.sleepTime())
+
+	writeLog(t, dir, "orflog.toml", "log-paths = [\"./missing-dir\"]")
+	assert.True(t, waitFor(func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.lines) > 0 && strings.HasPrefix(rec.lines[len(rec.lines)-1], "ERROR could not reload config, previous one kept")
+	}), "invalid config is not applied")
+	assert.Equal(t, []string{"second", "./test"}, sources())
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,136 @@
+package orflog
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message groups records of one mail message logged at different filtering points
+type Message struct {
+	ID          string // message id from log line if present, otherwise sender, related IP and time of the first event
+	Sender      string
+	Recipients  string // all recipients of events separated by ";" as ORF logs them
+	RelatedIP   string
+	First       time.Time
+	Last        time.Time
+	Events      []Orf  // in time order
+	Disposition string // Action of the last event
+}
+
+// CorrelatorOpts defines how records are grouped to messages
+type CorrelatorOpts struct {
+	Window time.Duration // max time between events of the same message, 2m by default
+}
+
+const correlationWindow = 2 * time.Minute
+
+var messageIDRe = regexp.MustCompile(`(?i)message-id:?\s*(<[^<>\s]+>)`)
+
+// Correlator groups records of the same message: records with the same message id, or with the same
+// sender and related IP logged within Window of each other, recipients of the group are collected
+// to Message.Recipients. Without message id mails of one sender and IP sent within Window are one
+// message. Records should be added in time order, as the service sends them. Not safe for concurrent use.
+type Correlator struct {
+	CorrelatorOpts
+	open map[string]*Message
+}
+
+// NewCorrelator makes correlator with defaults for empty opts
+func NewCorrelator(opts CorrelatorOpts) *Correlator {
+	if opts.Window <= 0 {
+		opts.Window = correlationWindow
+	}
+	return &Correlator{CorrelatorOpts: opts, open: make(map[string]*Message)}
+}
+
+// Add adds record and returns messages completed by its time, i.e. with the last event more than
+// Window before the record
+func (c *Correlator) Add(orf Orf) []Message {
+	result := c.complete(orf.Time)
+
+	key := correlationKey(orf)
+	msg, ok := c.open[key]
+	if !ok {
+		id := key
+		if messageID(orf) == "" {
+			id += "|" + orf.Time.UTC().Format(time.RFC3339Nano)
+		}
+		msg = &Message{ID: id, Sender: orf.Sender, Recipients: orf.Recipients, RelatedIP: orf.RelatedIP, First: orf.Time}
+		c.open[key] = msg
+	}
+	if !containsRecipient(msg.Recipients, orf.Recipients) {
+		msg.Recipients += ";" + orf.Recipients
+	}
+	msg.Events = append(msg.Events, orf)
+	sort.SliceStable(msg.Events, func(i, j int) bool { return msg.Events[i].Time.Before(msg.Events[j].Time) })
+	if orf.Time.Before(msg.First) {
+		msg.First = orf.Time
+	}
+	if orf.Time.After(msg.Last) {
+		msg.Last = orf.Time
+	}
+	msg.Disposition = msg.Events[len(msg.Events)-1].Action
+
+	return result
+}
+
+// Flush returns all collected messages, used at the end of the stream
+func (c *Correlator) Flush() []Message {
+	result := make([]Message, 0, len(c.open))
+	for key, msg := range c.open {
+		result = append(result, *msg)
+		delete(c.open, key)
+	}
+	sortMessages(result)
+	return result
+}
+
+// complete returns and forgets messages finished before now
+func (c *Correlator) complete(now time.Time) []Message {
+	var result []Message
+	for key, msg := range c.open {
+		if now.Sub(msg.Last) > c.Window {
+			result = append(result, *msg)
+			delete(c.open, key)
+		}
+	}
+	sortMessages(result)
+	return result
+}
+
+// correlationKey returns message id if present, otherwise key of sender and related IP. Recipient is not
+// a part of the key, ORF logs a record per recipient of the message.
+func correlationKey(orf Orf) string {
+	if id := messageID(orf); id != "" {
+		return id
+	}
+	return strings.ToLower(orf.Sender) + "|" + orf.RelatedIP
+}
+
+// messageID extracts message id from the message text
+func messageID(orf Orf) string {
+	if m := messageIDRe.FindStringSubmatch(orf.Message); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func containsRecipient(recipients, recipient string) bool {
+	for _, r := range strings.Split(recipients, ";") {
+		if strings.EqualFold(r, recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortMessages(msgs []Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		if !msgs[i].First.Equal(msgs[j].First) {
+			return msgs[i].First.Before(msgs[j].First)
+		}
+		return msgs[i].ID < msgs[j].ID
+	})
+}
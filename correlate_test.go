@@ -0,0 +1,74 @@
+package orflog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelator(t *testing.T) {
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	orf := func(sec int, action, point, recipient, message string) Orf {
+		return Orf{
+			Time:           start.Add(time.Duration(sec) * time.Second),
+			Action:         action,
+			FilteringPoint: point,
+			RelatedIP:      "10.10.10.10",
+			Sender:         "sender@sender.com",
+			Recipients:     recipient,
+			Message:        message,
+		}
+	}
+
+	c := NewCorrelator(CorrelatorOpts{})
+	assert.Empty(t, c.Add(orf(0, ifReject("WhitelistRecipient"), filterPoint("BeforeArrival"), "first@recipient.com", "")))
+	assert.Empty(t, c.Add(orf(1, ifReject("Reject"), filterPoint("BeforeArrival"), "second@recipient.com", "")))
+	assert.Empty(t, c.Add(orf(5, ifReject("ReplaceAttachment"), filterPoint("OnArrival"), "First@recipient.com", "")))
+	assert.Empty(t, c.Add(orf(10, "", "", "a@recipient.com", "Message-ID: <id1@sender.com> ")))
+	assert.Empty(t, c.Add(orf(11, "", "", "b@recipient.com", "message-id <id1@sender.com> ")))
+
+	msgs := c.Add(orf(300, "", "", "later@recipient.com", ""))
+	if !assert.Equal(t, 2, len(msgs)) {
+		return
+	}
+
+	// two recipients without message id
+	assert.Equal(t, "sender@sender.com|10.10.10.10|2019-07-06T10:00:00Z", msgs[0].ID)
+	assert.Equal(t, "first@recipient.com;second@recipient.com", msgs[0].Recipients)
+	assert.Equal(t, 3, len(msgs[0].Events))
+	assert.Equal(t, ifReject("ReplaceAttachment"), msgs[0].Disposition)
+	assert.Equal(t, start, msgs[0].First)
+	assert.Equal(t, start.Add(5*time.Second), msgs[0].Last)
+
+	assert.Equal(t, "<id1@sender.com>", msgs[1].ID)
+	assert.Equal(t, "a@recipient.com;b@recipient.com", msgs[1].Recipients)
+	assert.Equal(t, 2, len(msgs[1].Events))
+
+	rest := c.Flush()
+	assert.Equal(t, 1, len(rest))
+	assert.Equal(t, "later@recipient.com", rest[0].Recipients)
+	assert.Equal(t, "sender@sender.com|10.10.10.10|2019-07-06T10:05:00Z", rest[0].ID, "the same sender later is another message")
+	assert.Empty(t, c.Flush())
+
+	// other sender or related IP is another message
+	c.Add(orf(0, ifReject("Reject"), "", "first@recipient.com", ""))
+	other := orf(0, ifReject("Reject"), "", "first@recipient.com", "")
+	other.RelatedIP = "10.10.10.11"
+	c.Add(other)
+	assert.Equal(t, 2, len(c.Flush()))
+}
+
+func TestCorrelator_recipients(t *testing.T) {
+	// test.log has a line with two recipients and no message id
+	svc := NewService(Opts{LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour})
+	c := NewCorrelator(CorrelatorOpts{})
+	for _, orf := range svc.GetLastRecords() {
+		assert.Empty(t, c.Add(*orf))
+	}
+	msgs := c.Flush()
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, "first@recipient.com;second@recipient.com", msgs[0].Recipients)
+		assert.Equal(t, 2, len(msgs[0].Events))
+	}
+}
@@ -0,0 +1,52 @@
+package orflog
+
+import (
+	"time"
+)
+
+// CycleInfo describes finished scan cycle
+type CycleInfo struct {
+	Cycle   uint64
+	Start   time.Time
+	End     time.Time
+	Scanned int // records read from log files
+	Records int // new records to send
+}
+
+// cycleObserver is registered observer, pointer identifies it for removal
+type cycleObserver struct {
+	fn func(info CycleInfo)
+}
+
+// ObserveCycles calls fn after every scan cycle, before its records are sent to subscribers.
+// fn is called by the scanning goroutine and delays the next scan, so it should return quickly.
+// Returned func removes observer.
+func (s *Service) ObserveCycles(fn func(info CycleInfo)) func() {
+	obs := &cycleObserver{fn: fn}
+	s.subs.Lock()
+	s.subs.observers = append(s.subs.observers, obs)
+	s.subs.Unlock()
+
+	return func() {
+		s.subs.Lock()
+		defer s.subs.Unlock()
+		for i, o := range s.subs.observers {
+			if o == obs {
+				s.subs.observers = append(s.subs.observers[:i:i], s.subs.observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notifyCycle calls cycle observers
+func (s *Service) notifyCycle(info CycleInfo) {
+	s.subs.RLock()
+	observers := make([]*cycleObserver, len(s.subs.observers))
+	copy(observers, s.subs.observers)
+	s.subs.RUnlock()
+
+	for _, obs := range observers {
+		obs.fn(info)
+	}
+}
@@ -0,0 +1,30 @@
+package orflog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_ObserveCycles(t *testing.T) {
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour})
+	var cycles []CycleInfo
+	remove := svc.ObserveCycles(func(info CycleInfo) { cycles = append(cycles, info) })
+
+	svc.GetLastRecords()
+	svc.GetLastRecords()
+	remove()
+	svc.GetLastRecords()
+
+	if !assert.Equal(t, 2, len(cycles)) {
+		return
+	}
+	assert.Equal(t, uint64(1), cycles[0].Cycle)
+	assert.Equal(t, 2, cycles[0].Scanned)
+	assert.Equal(t, 2, cycles[0].Records)
+	assert.False(t, cycles[0].End.Before(cycles[0].Start))
+	assert.Equal(t, uint64(2), cycles[1].Cycle)
+	assert.Equal(t, 0, cycles[1].Scanned, "unchanged file is not read again")
+	assert.Equal(t, 0, cycles[1].Records)
+}
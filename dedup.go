@@ -0,0 +1,268 @@
+package orflog
+
+import (
+	"crypto/md5" //nolint:gosec
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DedupOpts defines memory limits of the index used to skip already sent records
+type DedupOpts struct {
+	MaxEntries        int           `long:"max-entries" env:"MAX_ENTRIES" default:"0" description:"hard limit of remembered records, 0 is unlimited"`
+	Bucket            time.Duration `long:"bucket" env:"BUCKET" default:"1h" description:"records are remembered and evicted in buckets of this time"`
+	Probabilistic     bool          `long:"probabilistic" env:"PROBABILISTIC" description:"remember records in bloom filters"`
+	FalsePositiveRate float64       `long:"false-positive-rate" env:"FALSE_POSITIVE_RATE" default:"0.001" description:"probability to skip new record in probabilistic mode"`
+	BloomCapacity     int           `long:"bloom-capacity" env:"BLOOM_CAPACITY" default:"100000" description:"records in one bloom filter"`
+}
+
+// DedupStats describes state of the dedup index
+type DedupStats struct {
+	Entries       int   // remembered records
+	Buckets       int   // time buckets
+	Evicted       int64 // records forgotten because of MaxEntries
+	Refused       int64 // scanned records treated as sent because their bucket was evicted
+	Expired       int64 // records forgotten because they left retention window
+	Probabilistic bool
+	FilterBytes   int // memory used by bloom filters
+}
+
+const (
+	dedupBucketTime   = time.Hour
+	falsePositiveRate = 0.001
+	bloomCapacity     = 100000
+)
+
+type dedupKey [md5.Size]byte
+
+// dedupBucket keeps records of one time range, exact hashes or bloom filters in probabilistic mode
+type dedupBucket struct {
+	keys    map[dedupKey]struct{}
+	filters []*bloomFilter
+	count   int
+}
+
+// dedupIndex remembers hashes of sent records grouped in buckets by record time. Buckets are
+// dropped when they leave retention window, or the oldest ones when MaxEntries is exceeded.
+// Records of evicted buckets are still in the window and rescanned every cycle, so all records
+// up to the end of the last evicted bucket are treated as known. The newest bucket and the one
+// just added to are never evicted, MaxEntries may be exceeded for them. Safe for concurrent use.
+type dedupIndex struct {
+	DedupOpts
+
+	mu        sync.Mutex
+	buckets   map[int64]*dedupBucket
+	order     []int64 // sorted bucket keys
+	count     int
+	evicted   int64
+	evictedTo int64 // end of the last evicted bucket, records before it are known
+	refused   int64
+	expired   int64
+}
+
+func newDedupIndex(opts DedupOpts) *dedupIndex {
+	res := &dedupIndex{DedupOpts: opts, buckets: make(map[int64]*dedupBucket)}
+	if res.Bucket <= 0 {
+		res.Bucket = dedupBucketTime
+	}
+	if res.FalsePositiveRate <= 0 || res.FalsePositiveRate >= 1 {
+		res.FalsePositiveRate = falsePositiveRate
+	}
+	if res.BloomCapacity <= 0 {
+		res.BloomCapacity = bloomCapacity
+	}
+	return res
+}
+
+// add remembers record, returns false if the record is already known
+func (d *dedupIndex) add(hash string, t time.Time) bool {
+	key := makeDedupKey(hash)
+	bk := d.bucketKey(t)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if bk < d.evictedTo {
+		return false
+	}
+
+	b, ok := d.buckets[bk]
+	if !ok {
+		b = &dedupBucket{}
+		if !d.Probabilistic {
+			b.keys = make(map[dedupKey]struct{})
+		}
+		d.buckets[bk] = b
+		i := sort.Search(len(d.order), func(i int) bool { return d.order[i] >= bk })
+		d.order = append(d.order, 0)
+		copy(d.order[i+1:], d.order[i:])
+		d.order[i] = bk
+	}
+
+	if b.contains(key) {
+		return false
+	}
+	d.insert(b, key)
+	d.count++
+
+	for d.MaxEntries > 0 && d.count > d.MaxEntries && len(d.order) > 1 && d.order[0] != bk {
+		oldest := d.order[0]
+		d.evicted += int64(d.remove(oldest))
+		d.evictedTo = oldest + int64(d.Bucket)
+	}
+	return true
+}
+
+// contains checks if record is known
+func (d *dedupIndex) contains(hash string, t time.Time) bool {
+	key := makeDedupKey(hash)
+	bk := d.bucketKey(t)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if bk < d.evictedTo {
+		return true
+	}
+	b, ok := d.buckets[bk]
+	return ok && b.contains(key)
+}
+
+// refuse checks if record is before the end of evicted buckets, such records can't be checked
+// and are counted as refused
+func (d *dedupIndex) refuse(t time.Time) bool {
+	bk := d.bucketKey(t)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if bk >= d.evictedTo {
+		return false
+	}
+	d.refused++
+	return true
+}
+
+// expire forgets buckets with all records before from and returns number of forgotten records
+func (d *dedupIndex) expire(from time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	count := 0
+	for len(d.order) > 0 && d.order[0]+int64(d.Bucket) <= from.UnixNano() {
+		count += d.remove(d.order[0])
+	}
+	d.expired += int64(count)
+	return count
+}
+
+// size returns number of remembered records
+func (d *dedupIndex) size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// stats returns current state of the index
+func (d *dedupIndex) stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := DedupStats{
+		Entries:       d.count,
+		Buckets:       len(d.buckets),
+		Evicted:       d.evicted,
+		Refused:       d.refused,
+		Expired:       d.expired,
+		Probabilistic: d.Probabilistic,
+	}
+	for _, b := range d.buckets {
+		for _, f := range b.filters {
+			res.FilterBytes += len(f.bits) * 8
+		}
+	}
+	return res
+}
+
+func (d *dedupIndex) bucketKey(t time.Time) int64 {
+	return t.Truncate(d.Bucket).UnixNano()
+}
+
+func (d *dedupIndex) insert(b *dedupBucket, key dedupKey) {
+	b.count++
+	if !d.Probabilistic {
+		b.keys[key] = struct{}{}
+		return
+	}
+	if len(b.filters) == 0 || b.filters[len(b.filters)-1].count >= d.BloomCapacity {
+		b.filters = append(b.filters, newBloomFilter(d.BloomCapacity, d.FalsePositiveRate))
+	}
+	b.filters[len(b.filters)-1].add(key)
+}
+
+// remove drops bucket, must be called under mu
+func (d *dedupIndex) remove(bk int64) int {
+	b, ok := d.buckets[bk]
+	if !ok {
+		return 0
+	}
+	delete(d.buckets, bk)
+	i := sort.Search(len(d.order), func(i int) bool { return d.order[i] >= bk })
+	d.order = append(d.order[:i], d.order[i+1:]...)
+	d.count -= b.count
+	return b.count
+}
+
+func (b *dedupBucket) contains(key dedupKey) bool {
+	if b.keys != nil {
+		_, ok := b.keys[key]
+		return ok
+	}
+	for _, f := range b.filters {
+		if f.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeDedupKey converts hex hash of Orf to bytes, any other string is hashed
+func makeDedupKey(hash string) (key dedupKey) {
+	if len(hash) == hex.EncodedLen(len(key)) {
+		if _, err := hex.Decode(key[:], []byte(hash)); err == nil {
+			return key
+		}
+	}
+	return md5.Sum([]byte(hash)) //nolint:gosec
+}
+
+// bloomFilter is a fixed size bloom filter for dedup keys
+type bloomFilter struct {
+	bits  []uint64
+	k     uint64
+	count int
+}
+
+// newBloomFilter makes filter for n keys with false positive probability p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{bits: make([]uint64, int(m)/64+1), k: uint64(k)}
+}
+
+func (f *bloomFilter) add(key dedupKey) {
+	f.count++
+	h1, h2, m := binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:]), uint64(len(f.bits)*64)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) contains(key dedupKey) bool {
+	h1, h2, m := binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:]), uint64(len(f.bits)*64)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package orflog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupIndex(t *testing.T) {
+	d := newDedupIndex(DedupOpts{})
+	now := time.Now()
+
+	assert.True(t, d.add("h1", now.Add(-2*time.Hour)))
+	assert.False(t, d.add("h1", now.Add(-2*time.Hour)))
+	assert.True(t, d.add("h2", now))
+	assert.True(t, d.contains("h1", now.Add(-2*time.Hour)))
+	assert.Equal(t, 2, d.size())
+
+	assert.Equal(t, 1, d.expire(now.Add(-time.Minute)))
+	assert.False(t, d.contains("h1", now.Add(-2*time.Hour)))
+	assert.True(t, d.contains("h2", now))
+	assert.Equal(t, DedupStats{Entries: 1, Buckets: 1, Expired: 1}, d.stats())
+}
+
+func TestDedupIndex_MaxEntries(t *testing.T) {
+	d := newDedupIndex(DedupOpts{MaxEntries: 3, Bucket: time.Minute})
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 6; i++ {
+		assert.True(t, d.add(fmt.Sprintf("h%d", i), start.Add(time.Duration(i)*30*time.Second)))
+	}
+	stats := d.stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(4), stats.Evicted)
+	assert.True(t, d.contains("h5", start.Add(150*time.Second)))
+	assert.True(t, d.contains("h0", start), "evicted records are known")
+	assert.True(t, d.contains("other", start.Add(90*time.Second)), "up to the end of the last evicted bucket")
+	assert.False(t, d.add("h1", start.Add(30*time.Second)))
+	assert.False(t, d.contains("other", start.Add(2*time.Minute)))
+}
+
+func TestDedupIndex_MaxEntriesOneBucket(t *testing.T) {
+	d := newDedupIndex(DedupOpts{MaxEntries: 3})
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, d.add(fmt.Sprintf("h%d", i), start.Add(time.Duration(i)*time.Minute)), "record %d", i)
+	}
+	assert.Equal(t, DedupStats{Entries: 5, Buckets: 1}, d.stats(), "current bucket is not evicted")
+
+	// bucket of late record is kept while records are added to it, then evicted with older ones
+	assert.True(t, d.add("late", start.Add(-time.Hour)))
+	assert.True(t, d.add("next", start.Add(time.Hour)))
+	assert.Equal(t, int64(6), d.stats().Evicted)
+	assert.True(t, d.refuse(start.Add(-time.Hour)))
+	assert.True(t, d.refuse(start))
+	assert.False(t, d.refuse(start.Add(time.Hour)))
+	assert.Equal(t, int64(2), d.stats().Refused)
+}
+
+func TestService_MaxEntriesNoResend(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Now().Truncate(time.Hour)
+	lines := make([]string, 0, 5)
+	for i := 5; i > 0; i-- {
+		lines = append(lines, orfLogLine(now.Add(-time.Duration(i)*time.Hour), fmt.Sprintf("day%d@sender.com", i)))
+	}
+	writeLog(t, dir, "a.log", strings.Join(lines, "\n"))
+
+	svc := NewService(Opts{LogPaths: []string{dir}, Retention: 24 * time.Hour, Dedup: DedupOpts{MaxEntries: 1}, Logger: NopLogger})
+	assert.Equal(t, 5, len(svc.GetLastRecords()))
+	for cycle := 1; cycle <= 3; cycle++ {
+		assert.Equal(t, 0, len(svc.GetLastRecords()), "cycle %d", cycle)
+	}
+	assert.Equal(t, 1, svc.DedupStats().Entries)
+
+	writeLog(t, dir, "a.log", strings.Join(append(lines, orfLogLine(now.Add(time.Minute), "new@sender.com")), "\n"))
+	if orfs := svc.GetLastRecords(); assert.Equal(t, 1, len(orfs)) {
+		assert.Equal(t, "new@sender.com", orfs[0].Sender)
+	}
+}
+
+func TestDedupIndex_Probabilistic(t *testing.T) {
+	d := newDedupIndex(DedupOpts{Probabilistic: true, BloomCapacity: 1000, FalsePositiveRate: 0.01})
+	now := time.Now()
+
+	added := 0
+	for i := 0; i < 2000; i++ {
+		orf := Orf{Sender: fmt.Sprintf("sender%d@sender.com", i), Time: now}
+		orf.Hash()
+		if d.add(orf.HashString, orf.Time) {
+			added++
+		}
+	}
+	assert.True(t, added > 1900, "false positives on add %d", 2000-added)
+
+	falsePositives := 0
+	for i := 0; i < 2000; i++ {
+		orf := Orf{Sender: fmt.Sprintf("sender%d@sender.com", i), Time: now}
+		orf.Hash()
+		assert.True(t, d.contains(orf.HashString, orf.Time))
+
+		orf = Orf{Sender: fmt.Sprintf("other%d@sender.com", i), Time: now}
+		orf.Hash()
+		if d.contains(orf.HashString, orf.Time) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 100, "false positives %d", falsePositives)
+
+	stats := d.stats()
+	assert.Equal(t, added, stats.Entries)
+	assert.True(t, stats.Probabilistic)
+	assert.True(t, stats.FilterBytes > 0 && stats.FilterBytes < 4096, "filter bytes %d", stats.FilterBytes)
+}
+
+func TestDedupIndex_Concurrent(t *testing.T) {
+	d := newDedupIndex(DedupOpts{})
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	added := make(chan bool, 400)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				added <- d.add(fmt.Sprintf("h%d", j), now.Add(time.Duration(j)*time.Hour))
+				d.expire(now)
+			}
+		}()
+	}
+	wg.Wait()
+	close(added)
+
+	count := 0
+	for ok := range added {
+		if ok {
+			count++
+		}
+	}
+	assert.Equal(t, 100, count, "every hash added once")
+	assert.Equal(t, 100, d.size())
+}
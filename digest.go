@@ -0,0 +1,546 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DigestOpts defines content, schedule and delivery of digests
+type DigestOpts struct {
+	From         string        `long:"from" env:"FROM" description:"sender address of digests"`
+	Subject      string        `long:"subject" env:"SUBJECT" default:"Blocked mail digest" description:"subject of digests"`
+	Interval     time.Duration `long:"interval" env:"INTERVAL" default:"24h" description:"time between digests"`
+	At           string        `long:"at" env:"AT" description:"local time of daily digest, HH:MM, overrides interval"`
+	DryRunDir    string        `long:"dry-run-dir" env:"DRY_RUN_DIR" description:"write digests to .eml files in this directory instead of sending"`
+	TextTemplate string        `long:"text-template" env:"TEXT_TEMPLATE" description:"text/template of plain text part, executed with DigestData"`
+	HTMLTemplate string        `long:"html-template" env:"HTML_TEMPLATE" description:"html/template of html part, executed with DigestData"`
+	StateFile    string        `long:"state-file" env:"STATE_FILE" description:"file with times of the last digests, records since them are replayed after restart"`
+	SMTP         SMTPOpts      `group:"smtp" namespace:"smtp" env-namespace:"SMTP"`
+
+	Logger Logger `no-flag:"true"` // global lgr logger by default
+}
+
+// SMTPOpts defines SMTP server to send mail
+type SMTPOpts struct {
+	Host     string        `long:"host" env:"HOST" description:"SMTP server host"`
+	Port     int           `long:"port" env:"PORT" default:"25" description:"SMTP server port"`
+	Username string        `long:"username" env:"USERNAME" description:"user for PLAIN auth, no auth if empty"`
+	Password string        `long:"password" env:"PASSWORD" description:"password for PLAIN auth"`
+	StartTLS bool          `long:"starttls" env:"STARTTLS" description:"require STARTTLS"`
+	Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"timeout of SMTP connect, command or message"`
+
+	TLSConfig *tls.Config `no-flag:"true"` // config of STARTTLS, ServerName is Host by default
+}
+
+// DigestData is passed to digest templates
+type DigestData struct {
+	Recipient string // normalized recipient address
+	Since     time.Time
+	Until     time.Time
+	Records   []Orf // in time order
+}
+
+// Digest collects non-delivered records by recipient and mails every recipient summary of
+// records blocked for them on a schedule. Safe for concurrent use.
+type Digest struct {
+	DigestOpts
+	text *template.Template
+	html *htmltemplate.Template
+
+	mu       sync.Mutex
+	pending  map[string][]Orf     // by recipient
+	since    time.Time            // time of the last digest
+	failed   map[string]time.Time // start of digests not delivered yet, by recipient
+	restored digestState          // loaded from StateFile, records before it are already sent
+}
+
+// digestState is kept in StateFile after every digest
+type digestState struct {
+	Since  time.Time
+	Failed map[string]time.Time `json:",omitempty"`
+}
+
+const (
+	digestSubject  = "Blocked mail digest"
+	digestInterval = 24 * time.Hour
+	smtpPort       = 25
+	smtpTimeout    = 30 * time.Second
+)
+
+const digestTextTemplate = `Mail for {{.Recipient}} blocked from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04"}}:
+{{range .Records}}
+{{.Time.Local.Format "2006-01-02 15:04:05"}}  {{.Sender}}  {{.Action}}{{if .Reason.Test}} ({{.Reason.Test}}: {{.Reason.Detail}}){{end}}{{end}}
+`
+
+const digestHTMLTemplate = `<html><body>
+<p>Mail for <b>{{.Recipient}}</b> blocked from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04"}}:</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Time</th><th>Sender</th><th>Action</th><th>Reason</th></tr>
+{{range .Records}}<tr><td>{{.Time.Local.Format "2006-01-02 15:04:05"}}</td><td>{{.Sender}}</td><td>{{.Action}}</td><td>{{.Reason.Test}} {{.Reason.Detail}}</td></tr>
+{{end}}</table>
+</body></html>
+`
+
+// NonDelivery checks if record's mail wasn't delivered to the recipient
+func (o Orf) NonDelivery() bool {
+	return o.Action == ifReject("Reject") || o.Action == ifReject("RemoveRecipient")
+}
+
+// NewDigest makes digest with defaults for empty opts
+func NewDigest(opts DigestOpts) (*Digest, error) {
+	if opts.From == "" {
+		return nil, errors.New("digest sender is not set")
+	}
+	if opts.SMTP.Host == "" && opts.DryRunDir == "" {
+		return nil, errors.New("smtp host is not set")
+	}
+	if opts.Subject == "" {
+		opts.Subject = digestSubject
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = digestInterval
+	}
+	if opts.At != "" {
+		if _, err := time.Parse("15:04", opts.At); err != nil {
+			return nil, fmt.Errorf("invalid digest time %q: %v", opts.At, err)
+		}
+	}
+	if opts.TextTemplate == "" {
+		opts.TextTemplate = digestTextTemplate
+	}
+	if opts.HTMLTemplate == "" {
+		opts.HTMLTemplate = digestHTMLTemplate
+	}
+	if opts.SMTP.Port <= 0 {
+		opts.SMTP.Port = smtpPort
+	}
+	if opts.SMTP.Timeout <= 0 {
+		opts.SMTP.Timeout = smtpTimeout
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+
+	res := &Digest{DigestOpts: opts, pending: make(map[string][]Orf), since: time.Now(), failed: make(map[string]time.Time)}
+	if opts.StateFile != "" {
+		data, err := ioutil.ReadFile(opts.StateFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if err = json.Unmarshal(data, &res.restored); err != nil {
+				return nil, errors.New("invalid digest state file: " + err.Error())
+			}
+			res.since = res.restored.Since
+			for recipient, since := range res.restored.Failed {
+				res.failed[recipient] = since
+			}
+		}
+	}
+	var err error
+	if res.text, err = template.New("text").Parse(opts.TextTemplate); err != nil {
+		return nil, fmt.Errorf("invalid digest text template: %v", err)
+	}
+	if res.html, err = htmltemplate.New("html").Parse(opts.HTMLTemplate); err != nil {
+		return nil, fmt.Errorf("invalid digest html template: %v", err)
+	}
+	return res, nil
+}
+
+// Run collects non-delivered records of the service and sends digests on schedule until ctx is done
+// or the service terminated. Digests are sent in background, so slow SMTP server doesn't hold records
+// of the service; digest is skipped if the previous one is still being sent. Records collected after
+// the last digest are not sent on exit, with StateFile they are replayed by the next run if they are
+// still in the retention window of the service.
+func (d *Digest) Run(ctx context.Context, svc *Service) {
+	ch, cancel := svc.Subscribe(func(orf Orf) bool { return orf.NonDelivery() }, SubscribeOpts{Since: d.replayFrom()})
+	defer cancel()
+
+	var sending sync.WaitGroup
+	defer sending.Wait()
+	busy := make(chan struct{}, 1)
+
+	timer := time.NewTimer(time.Until(d.next(time.Now())))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case orf, ok := <-ch:
+			if !ok {
+				return
+			}
+			d.Add(orf)
+		case <-timer.C:
+			select {
+			case busy <- struct{}{}:
+				sending.Add(1)
+				go func() {
+					defer sending.Done()
+					if err := d.Send(ctx); err != nil {
+						d.Logger.Warn("could not send digests", "error", err)
+					}
+					<-busy
+				}()
+			default:
+				d.Logger.Warn("previous digest is still being sent, digest skipped")
+			}
+			timer.Reset(time.Until(d.next(time.Now())))
+		}
+	}
+}
+
+// Add collects record if it is non-delivery, recipients are compared case-insensitively
+func (d *Digest) Add(orf Orf) {
+	if !orf.NonDelivery() {
+		return
+	}
+	recipient := orf.RecipientAddress.Normalized
+	if recipient == "" {
+		recipient = ParseAddress(orf.Recipients).Normalized
+	}
+	if recipient == "" {
+		return
+	}
+	recipient = strings.ToLower(recipient)
+	if orf.Time.Before(d.restored.since(recipient)) {
+		return // replayed record already sent to the recipient before restart
+	}
+	d.mu.Lock()
+	d.pending[recipient] = append(d.pending[recipient], orf)
+	d.mu.Unlock()
+}
+
+// replayFrom returns the earliest start of digests not sent before restart, zero without saved state
+func (d *Digest) replayFrom() time.Time {
+	res := d.restored.Since
+	for _, since := range d.restored.Failed {
+		if since.Before(res) {
+			res = since
+		}
+	}
+	return res
+}
+
+// since returns start of the next digest of recipient
+func (st digestState) since(recipient string) time.Time {
+	if since, ok := st.Failed[recipient]; ok {
+		return since
+	}
+	return st.Since
+}
+
+// Send mails digests of all collected records, records of recipients not delivered to are kept for the next
+// digest, which starts from the same time for them
+func (d *Digest) Send(ctx context.Context) error {
+	now := time.Now()
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[string][]Orf)
+	from := make(map[string]time.Time, len(pending))
+	for recipient := range pending {
+		from[recipient] = digestState{Since: d.since, Failed: d.failed}.since(recipient)
+	}
+	d.since = now
+	d.mu.Unlock()
+
+	recipients := make([]string, 0, len(pending))
+	for recipient := range pending {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+
+	delivered := make(map[string]bool, len(recipients))
+	defer d.finish(recipients, pending, from, delivered)
+
+	messages := make(map[string][]byte, len(recipients))
+	for _, recipient := range recipients {
+		records := pending[recipient]
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+		msg, err := d.message(DigestData{Recipient: recipient, Since: from[recipient], Until: now, Records: records})
+		if err != nil {
+			return err
+		}
+		messages[recipient] = msg
+	}
+
+	var errs []string
+	deliver := d.sendMail
+	if d.DryRunDir != "" {
+		deliver = d.writeEML
+	}
+	if err := deliver(ctx, recipients, messages, func(recipient string, err error) {
+		if err == nil {
+			delivered[recipient] = true
+			return
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", recipient, err))
+	}); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// finish requeues records of recipients not delivered to, keeping start of their digests, and saves state
+func (d *Digest) finish(recipients []string, pending map[string][]Orf, from map[string]time.Time, delivered map[string]bool) {
+	retry := make(map[string][]Orf, len(recipients)-len(delivered))
+	d.mu.Lock()
+	for _, recipient := range recipients {
+		if delivered[recipient] {
+			delete(d.failed, recipient)
+			continue
+		}
+		retry[recipient] = pending[recipient]
+		d.failed[recipient] = from[recipient]
+	}
+	d.mu.Unlock()
+	d.requeue(retry)
+
+	if err := d.saveState(); err != nil {
+		d.Logger.Warn("could not save digest state", "path", d.StateFile, "error", err)
+	}
+}
+
+// saveState writes time of the last digest and starts of failed ones to temporary file and renames it
+func (d *Digest) saveState() error {
+	if d.StateFile == "" {
+		return nil
+	}
+	d.mu.Lock()
+	data, err := json.Marshal(digestState{Since: d.since, Failed: d.failed})
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.StateFile), filepath.Base(d.StateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.StateFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// requeue returns records to pending
+func (d *Digest) requeue(records map[string][]Orf) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for recipient, orfs := range records {
+		d.pending[recipient] = append(orfs, d.pending[recipient]...)
+	}
+}
+
+// next returns time of the digest after now
+func (d *Digest) next(now time.Time) time.Time {
+	if d.At == "" {
+		return now.Add(d.Interval)
+	}
+	at, _ := time.Parse("15:04", d.At)
+	res := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !res.After(now) {
+		res = res.AddDate(0, 0, 1)
+	}
+	return res
+}
+
+// message renders mail with text and html parts
+func (d *Digest) message(data DigestData) ([]byte, error) {
+	var text, html bytes.Buffer
+	if err := d.text.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("could not render digest text: %v", err)
+	}
+	if err := d.html.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("could not render digest html: %v", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", d.From},
+		{"To", data.Recipient},
+		{"Subject", mime.QEncoding.Encode("utf-8", d.Subject)},
+		{"Date", data.Until.Format(time.RFC1123Z)},
+		{"Message-ID", messageIDHeader(d.From)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, h := range headers {
+		msg.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendMail delivers messages in one SMTP session, done is called with nil error for every message accepted
+// by server and with error of recipient rejected by server. Every command and message gets SMTP.Timeout.
+func (d *Digest) sendMail(ctx context.Context, recipients []string, messages map[string][]byte, done func(string, error)) error {
+	addr := net.JoinHostPort(d.SMTP.Host, strconv.Itoa(d.SMTP.Port))
+	dialer := net.Dialer{Timeout: d.SMTP.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	extend := func() error { return conn.SetDeadline(time.Now().Add(d.SMTP.Timeout)) }
+	if err = extend(); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, d.SMTP.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close() //nolint:errcheck
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		cfg := d.SMTP.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{ServerName: d.SMTP.Host} //nolint:gosec
+		}
+		if err = extend(); err != nil {
+			return err
+		}
+		if err = c.StartTLS(cfg); err != nil {
+			return err
+		}
+	} else if d.SMTP.StartTLS {
+		return errors.New("smtp server doesn't support STARTTLS")
+	}
+
+	if d.SMTP.Username != "" {
+		if err = extend(); err != nil {
+			return err
+		}
+		if err = c.Auth(smtp.PlainAuth("", d.SMTP.Username, d.SMTP.Password, d.SMTP.Host)); err != nil {
+			return err
+		}
+	}
+
+	for _, recipient := range recipients {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = extend(); err != nil {
+			return err
+		}
+		if err = d.deliver(c, recipient, messages[recipient]); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err // connection is broken
+			}
+			done(recipient, err)
+			if err = c.Reset(); err != nil {
+				return err
+			}
+			continue
+		}
+		done(recipient, nil)
+	}
+	if err = extend(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// deliver sends one message in the session
+func (d *Digest) deliver(c *smtp.Client, recipient string, msg []byte) error {
+	if err := c.Mail(d.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(recipient); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeEML writes messages to DryRunDir as time-recipient.eml files
+func (d *Digest) writeEML(_ context.Context, recipients []string, messages map[string][]byte, done func(string, error)) error {
+	if err := os.MkdirAll(d.DryRunDir, 0700); err != nil {
+		return err
+	}
+	stamp := time.Now().Format("20060102-150405")
+	for _, recipient := range recipients {
+		name := stamp + "-" + strings.NewReplacer("/", "_", "\\", "_").Replace(recipient) + ".eml"
+		done(recipient, ioutil.WriteFile(filepath.Join(d.DryRunDir, name), messages[recipient], 0600))
+	}
+	return nil
+}
+
+// messageIDHeader makes unique Message-ID in the domain of from address
+func messageIDHeader(from string) string {
+	domain := ParseAddress(from).Domain
+	if domain == "" {
+		domain = "localhost"
+	}
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("<%x.%d@%s>", b, time.Now().UnixNano(), domain)
+}
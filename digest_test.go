@@ -0,0 +1,403 @@
+package orflog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigest(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.close()
+
+	host, portStr, _ := net.SplitHostPort(srv.ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", Subject: "Заблокированная почта",
+		SMTP: SMTPOpts{Host: host, Port: port, Username: "user", Password: "password"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	d.Add(Orf{Time: start.Add(time.Minute), Action: ifReject("Reject"), Sender: "spam@spam.com", Recipients: "Ann@Example.com", Reason: ParseReason("DNSBL zen.spamhaus.org listed")})
+	d.Add(Orf{Time: start, Action: ifReject("RemoveRecipient"), Sender: "<x&y@spam.com>", Recipients: "ann@example.com"})
+	d.Add(Orf{Time: start, Action: ifReject("Reject"), Sender: "a@b.com", Recipients: "rejected@example.com"})
+	d.Add(Orf{Time: start, Action: ifReject("Accept"), Sender: "a@b.com", Recipients: "ann@example.com"})
+
+	since := d.since
+	err = d.Send(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rejected@example.com: 550")
+	}
+	assert.Equal(t, map[string]time.Time{"rejected@example.com": since}, d.failed, "failed digest keeps its start")
+	srv.mu.Lock()
+	assert.Equal(t, []string{"AUTH PLAIN AHVzZXIAcGFzc3dvcmQ="}, srv.auth)
+	if assert.Equal(t, 1, len(srv.messages)) {
+		assert.Equal(t, []string{"ann@example.com"}, srv.messages[0].rcpt)
+		msg, err := mail.ReadMessage(strings.NewReader(srv.messages[0].data))
+		if assert.NoError(t, err) {
+			subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			assert.Equal(t, "Заблокированная почта", subject)
+			assert.Equal(t, "ann@example.com", msg.Header.Get("To"))
+
+			_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			mr := multipart.NewReader(msg.Body, params["boundary"])
+			text, err := mr.NextPart()
+			if assert.NoError(t, err) {
+				body, _ := ioutil.ReadAll(text)
+				assert.Contains(t, string(body), "<x&y@spam.com>  "+ifReject("RemoveRecipient"))
+				assert.Contains(t, string(body), "spam@spam.com  "+ifReject("Reject")+" (dnsbl: listed)")
+				assert.True(t, strings.Index(string(body), "x&y") < strings.Index(string(body), "spam@spam.com"), "time order")
+			}
+			html, err := mr.NextPart()
+			if assert.NoError(t, err) {
+				body, _ := ioutil.ReadAll(html)
+				assert.Contains(t, string(body), "&lt;x&amp;y@spam.com&gt;")
+			}
+		}
+	}
+	srv.messages = nil
+	srv.mu.Unlock()
+
+	// failed recipient is kept for the next digest
+	srv.mu.Lock()
+	srv.reject = ""
+	srv.mu.Unlock()
+	assert.NoError(t, d.Send(context.Background()))
+	srv.mu.Lock()
+	if assert.Equal(t, 1, len(srv.messages)) {
+		assert.Equal(t, []string{"rejected@example.com"}, srv.messages[0].rcpt)
+		assert.Contains(t, srv.messages[0].data, "blocked from "+since.Format("2006-01-02 15:04"))
+	}
+	srv.mu.Unlock()
+	assert.Empty(t, d.failed)
+
+	d.SMTP.StartTLS = true
+	d.Add(Orf{Action: ifReject("Reject"), Recipients: "ann@example.com"})
+	assert.EqualError(t, d.Send(context.Background()), "smtp server doesn't support STARTTLS")
+	assert.Equal(t, 1, len(d.pending), "kept after failed session")
+}
+
+func TestDigest_brokenSession(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.close()
+	srv.hangup = "bob@example.com"
+
+	host, portStr, _ := net.SplitHostPort(srv.ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", SMTP: SMTPOpts{Host: host, Port: port}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, rcpt := range []string{"ann@example.com", "bob@example.com", "carl@example.com"} {
+		d.Add(Orf{Action: ifReject("Reject"), Recipients: rcpt})
+	}
+	assert.Error(t, d.Send(context.Background()))
+
+	srv.mu.Lock()
+	if assert.Equal(t, 1, len(srv.messages)) {
+		assert.Equal(t, []string{"ann@example.com"}, srv.messages[0].rcpt)
+	}
+	srv.messages = nil
+	srv.hangup = ""
+	srv.mu.Unlock()
+	d.mu.Lock()
+	assert.Equal(t, 2, len(d.pending), "delivered recipient is not requeued")
+	assert.Nil(t, d.pending["ann@example.com"])
+	d.mu.Unlock()
+
+	assert.NoError(t, d.Send(context.Background()))
+	srv.mu.Lock()
+	assert.Equal(t, 2, len(srv.messages))
+	srv.mu.Unlock()
+}
+
+func TestDigest_RunSlowServer(t *testing.T) {
+	// server accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", Interval: 10 * time.Millisecond, Logger: NopLogger,
+		SMTP: SMTPOpts{Host: host, Port: port, Timeout: time.Minute}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	svc := NewService(Opts{NoChannel: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, svc)
+		close(done)
+	}()
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("digest is not sent")
+	}
+
+	// records are received while digest is being sent
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			svc.publish(ctx, 1, Orf{Action: ifReject("Reject"), Recipients: "ann@example.com"})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish is blocked by digest")
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		d.mu.Lock()
+		n := len(d.pending["ann@example.com"])
+		d.mu.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			assert.Equal(t, 3, n)
+			break
+		}
+	}
+
+	cancel()
+	_ = conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run is not finished")
+	}
+}
+
+func TestDigest_DryRun(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, TextTemplate: "{{len .Records}} blocked"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	d.Add(Orf{Action: ifReject("Reject"), Recipients: "ann@пример.рф"})
+	assert.NoError(t, d.Send(context.Background()))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if assert.Equal(t, 1, len(files)) {
+		assert.True(t, strings.HasSuffix(files[0], "-ann@xn--e1afmkfd.xn--p1ai.eml"), files[0])
+		data, _ := ioutil.ReadFile(files[0])
+		assert.Contains(t, string(data), "1 blocked")
+	}
+
+	_, err = NewDigest(DigestOpts{From: "orf@example.com"})
+	assert.Error(t, err, "no smtp host")
+	_, err = NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, At: "25:00"})
+	assert.Error(t, err)
+}
+
+func TestDigest_StateFile(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "digest.json")
+
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, StateFile: state})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, d.replayFrom().IsZero(), "nothing to replay without state")
+	assert.NoError(t, d.Send(context.Background()))
+	d, err = NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, StateFile: state})
+	if assert.NoError(t, err) {
+		assert.False(t, d.replayFrom().IsZero(), "time of the last digest is restored")
+	}
+
+	// digest of the first recipient failed before the record, the second one got it
+	data, _ := json.Marshal(digestState{Since: time.Date(2019, 7, 7, 0, 0, 0, 0, time.UTC),
+		Failed: map[string]time.Time{"first@recipient.com": time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)}})
+	assert.NoError(t, ioutil.WriteFile(state, data, 0600))
+	d, err = NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, StateFile: state})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour, Logger: NopLogger})
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, svc)
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		d.mu.Lock()
+		n := len(d.pending)
+		d.mu.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	cancel()
+	<-done
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	assert.Equal(t, 1, len(d.pending), "record is replayed only for the recipient without digest")
+	assert.Equal(t, 1, len(d.pending["first@recipient.com"]))
+
+	_ = ioutil.WriteFile(state, []byte("{"), 0600)
+	_, err = NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: dir, StateFile: state})
+	assert.Error(t, err)
+}
+
+func TestDigest_next(t *testing.T) {
+	d, err := NewDigest(DigestOpts{From: "orf@example.com", DryRunDir: "unused", At: "08:30"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2019, 7, 7, 8, 30, 0, 0, time.UTC), d.next(now))
+	assert.Equal(t, time.Date(2019, 7, 6, 8, 30, 0, 0, time.UTC), d.next(now.Add(-2*time.Hour)))
+	d.At = ""
+	assert.Equal(t, now.Add(24*time.Hour), d.next(now))
+}
+
+// fakeSMTP accepts mail without TLS, rejects recipient with reject address
+type fakeSMTP struct {
+	ln       net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	reject   string
+	hangup   string // recipient to drop connection on
+	auth     []string
+	messages []fakeMessage
+}
+
+type fakeMessage struct {
+	rcpt []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeSMTP{ln: ln, reject: "rejected@example.com"}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.wg.Add(1)
+			go func() {
+				defer srv.wg.Done()
+				srv.serve(conn)
+			}()
+		}
+	}()
+	return srv
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(s string) {
+		_, _ = w.WriteString(s + "\r\n")
+		_ = w.Flush()
+	}
+	reply("220 fake ESMTP")
+	var msg fakeMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-fake\r\n250 AUTH PLAIN")
+		case "AUTH":
+			f.mu.Lock()
+			f.auth = append(f.auth, line)
+			f.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			msg = fakeMessage{}
+			reply("250 ok")
+		case "RCPT":
+			addr := strings.TrimSuffix(strings.TrimPrefix(line[len("RCPT TO:"):], "<"), ">")
+			f.mu.Lock()
+			rejected, hangup := addr == f.reject, addr == f.hangup
+			f.mu.Unlock()
+			if hangup {
+				return
+			}
+			if rejected {
+				reply("550 no such user")
+				continue
+			}
+			msg.rcpt = append(msg.rcpt, addr)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go on")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, fakeMessage{rcpt: msg.rcpt, data: data.String()})
+			f.mu.Unlock()
+			reply("250 queued")
+		case "RSET":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeSMTP) close() {
+	_ = f.ln.Close()
+	f.wg.Wait()
+}
@@ -0,0 +1,131 @@
+package orflog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Supported encodings of log files
+const (
+	EncodingAuto        = "auto"
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingWindows1251 = "windows-1251"
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// windows1251 maps bytes 0x80-0xFF of Windows-1251 to unicode
+var windows1251 = [128]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+	0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+	0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+	0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+	0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, 0x041F,
+	0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+	0x0428, 0x0429, 0x042A, 0x042B, 0x042C, 0x042D, 0x042E, 0x042F,
+	0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+	0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, 0x043F,
+	0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+	0x0448, 0x0449, 0x044A, 0x044B, 0x044C, 0x044D, 0x044E, 0x044F,
+}
+
+// validEncoding checks if encoding name is supported
+func validEncoding(enc string) bool {
+	switch strings.ToLower(enc) {
+	case EncodingAuto, EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE, EncodingWindows1251:
+		return true
+	default:
+		return false
+	}
+}
+
+// decode converts content of log file to string. BOM, if present, always wins over
+// configured encoding because ORF writes it for UTF-16 logs.
+// Auto mode without BOM picks UTF-8 for valid UTF-8, UTF-16 for text with zero bytes and Windows-1251 otherwise.
+func decode(b []byte, enc string) (string, error) {
+	switch {
+	case bytes.HasPrefix(b, bomUTF8):
+		return string(b[len(bomUTF8):]), nil
+	case bytes.HasPrefix(b, bomUTF16LE):
+		return decodeUTF16(b[len(bomUTF16LE):], false), nil
+	case bytes.HasPrefix(b, bomUTF16BE):
+		return decodeUTF16(b[len(bomUTF16BE):], true), nil
+	}
+
+	switch strings.ToLower(enc) {
+	case EncodingAuto, "":
+		return decode(b, detectEncoding(b))
+	case EncodingUTF8:
+		return string(b), nil
+	case EncodingUTF16LE:
+		return decodeUTF16(b, false), nil
+	case EncodingUTF16BE:
+		return decodeUTF16(b, true), nil
+	case EncodingWindows1251:
+		return decodeWindows1251(b), nil
+	default:
+		return "", fmt.Errorf("unsupported encoding %q", enc)
+	}
+}
+
+// detectEncoding guesses encoding of text without BOM
+func detectEncoding(b []byte) string {
+	if zero := bytes.IndexByte(b, 0); zero >= 0 && len(b) > 1 {
+		if zero%2 == 0 {
+			return EncodingUTF16BE
+		}
+		return EncodingUTF16LE
+	}
+	if utf8.Valid(b) {
+		return EncodingUTF8
+	}
+	return EncodingWindows1251
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+			continue
+		}
+		u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+	}
+	return string(utf16.Decode(u))
+}
+
+func decodeWindows1251(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b))
+	for _, c := range b {
+		if c < 0x80 {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteRune(windows1251[c-0x80])
+	}
+	return sb.String()
+}
+
+// splitLines splits text to lines, handles both LF and CRLF line endings
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
@@ -0,0 +1,69 @@
+package orflog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	utf16le := []byte{0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune("Привет\r\n")) {
+		utf16le = append(utf16le, byte(u), byte(u>>8))
+	}
+
+	cp1251 := []byte{0xCF, 0xF0, 0xE8, 0xE2, 0xE5, 0xF2, 0x20, 0xB8}
+
+	tbl := []struct {
+		name string
+		in   []byte
+		enc  string
+		out  string
+	}{
+		{"utf-8 bom", append([]byte{0xEF, 0xBB, 0xBF}, "Привет"...), EncodingAuto, "Привет"},
+		{"utf-16le bom", utf16le, EncodingUTF8, "Привет\r\n"},
+		{"utf-16be", []byte{0x04, 0x1F, 0x00, 0x41}, EncodingUTF16BE, "ПA"},
+		{"utf-16le auto", []byte{0x1F, 0x04, 0x41, 0x00}, EncodingAuto, "ПA"},
+		{"windows-1251", cp1251, EncodingWindows1251, "Привет ё"},
+		{"windows-1251 auto", cp1251, EncodingAuto, "Привет ё"},
+		{"utf-8 auto", []byte("Привет"), EncodingAuto, "Привет"},
+	}
+
+	for _, tt := range tbl {
+		out, err := decode(tt.in, tt.enc)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.out, out, tt.name)
+	}
+
+	_, err := decode([]byte("text"), "koi8-r")
+	assert.Error(t, err)
+}
+
+func TestSplitLines(t *testing.T) {
+	assert.Equal(t, []string{"first", "second", "third", ""}, splitLines("first\r\nsecond\nthird\r\n"))
+}
+
+func TestService_readLogFileEncoding(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	line := "SMTPSVC 2019-07-06T10:10:00 2 3 Reject BeforeArrival 10.10.10.10 sender@sender.com r@r.com 9 10 11 msg\r\n"
+	b := []byte{0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(line)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	writeLog(t, dir, "utf16.log", string(b))
+
+	svc := NewService(Opts{Sources: []Source{{Path: dir, Name: "orf01"}}})
+	res := svc.readLogFile(logFile{ctx: context.Background(), src: svc.sources[0], path: filepath.Join(dir, "utf16.log")})
+	if !assert.Equal(t, 1, len(res.records)) {
+		return
+	}
+	assert.Equal(t, "r@r.com", res.records[0].Recipients)
+	assert.Equal(t, "msg ", res.records[0].Message)
+	assert.Equal(t, "orf01", res.records[0].Source)
+}
@@ -0,0 +1,130 @@
+package orflog
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Rule matches records, empty fields match any value. Patterns are case-insensitive
+// shell patterns ("*@example.com"), Action and FilteringPoint are raw ORF values.
+type Rule struct {
+	Action         string // Reject, RemoveRecipient, ReplaceAttachment, WhitelistRecipient, ...
+	FilteringPoint string // BeforeArrival, OnArrival, ...
+	Sender         string
+	Recipient      string
+	IPRange        string // CIDR, "10.0.0.0/8"
+}
+
+// Rules selects records to process: with Include set, record must match one of Include rules,
+// record matching any of Exclude rules is dropped. Rules are applied while parsing, so excluded
+// records never get to dedup index or subscribers.
+type Rules struct {
+	Include []Rule
+	Exclude []Rule
+}
+
+// compiledRule is a validated Rule, invalid Include rule is kept as never matching
+type compiledRule struct {
+	Rule
+	ipNet   *net.IPNet
+	invalid bool
+}
+
+// ruleSet is compiled Rules
+type ruleSet struct {
+	include []compiledRule
+	exclude []compiledRule
+}
+
+// compileRules validates rules with warning about invalid ones. Invalid Include rule matches nothing,
+// so a typo can't make the filter pass all records, invalid Exclude rule is skipped.
+func compileRules(rules Rules, logger Logger) ruleSet {
+	compile := func(kind string, list []Rule) []compiledRule {
+		res := make([]compiledRule, 0, len(list))
+		for _, r := range list {
+			cr, err := compileRule(r)
+			if err != nil && kind == "include" {
+				logger.Warn("invalid rule matches nothing", "kind", kind, "rule", fmt.Sprintf("%+v", r), "error", err)
+				res = append(res, compiledRule{Rule: r, invalid: true})
+				continue
+			}
+			if err != nil {
+				logger.Warn("invalid rule skipped", "kind", kind, "rule", fmt.Sprintf("%+v", r), "error", err)
+				continue
+			}
+			res = append(res, cr)
+		}
+		return res
+	}
+	return ruleSet{include: compile("include", rules.Include), exclude: compile("exclude", rules.Exclude)}
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	res := compiledRule{Rule: r}
+	for _, pattern := range []string{r.Sender, r.Recipient} {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return res, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if r.IPRange != "" {
+		_, ipNet, err := net.ParseCIDR(r.IPRange)
+		if err != nil {
+			return res, err
+		}
+		res.ipNet = ipNet
+	}
+	return res, nil
+}
+
+// match checks if record passes rules
+func (rs ruleSet) match(orf *Orf) bool {
+	if len(rs.include) > 0 {
+		included := false
+		for _, r := range rs.include {
+			if r.match(orf) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, r := range rs.exclude {
+		if r.match(orf) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r compiledRule) match(orf *Orf) bool {
+	if r.invalid {
+		return false
+	}
+	if r.Action != "" && !strings.EqualFold(r.Action, orf.RawAction) {
+		return false
+	}
+	if r.FilteringPoint != "" && !strings.EqualFold(r.FilteringPoint, orf.RawFilteringPoint) {
+		return false
+	}
+	if !matchPattern(r.Sender, orf.Sender) || !matchPattern(r.Recipient, orf.Recipients) {
+		return false
+	}
+	if r.ipNet != nil && (orf.IP == nil || !r.ipNet.Contains(orf.IP)) {
+		return false
+	}
+	return true
+}
+
+// matchPattern matches address without angle brackets against case-insensitive pattern, empty pattern matches all
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(value), "<"), ">")
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return ok
+}
@@ -0,0 +1,60 @@
+package orflog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleSet_match(t *testing.T) {
+	rs := compileRules(Rules{
+		Include: []Rule{{Action: "reject"}, {Action: "WhitelistRecipient"}},
+		Exclude: []Rule{
+			{Sender: "*@spam.example.com"},
+			{FilteringPoint: "OnArrival", IPRange: "10.0.0.0/8"},
+			{IPRange: "invalid"},
+		},
+	}, NopLogger)
+	assert.Equal(t, 2, len(rs.exclude), "invalid rule skipped")
+
+	tbl := []struct {
+		orf  Orf
+		want bool
+	}{
+		{Orf{RawAction: "Reject", Sender: "<a@example.com>"}, true},
+		{Orf{RawAction: "Accept", Sender: "<a@example.com>"}, false},
+		{Orf{RawAction: "Reject", Sender: "<Bob@SPAM.example.com>"}, false},
+		{Orf{RawAction: "Reject", RawFilteringPoint: "OnArrival", IP: net.ParseIP("10.1.1.1")}, false},
+		{Orf{RawAction: "Reject", RawFilteringPoint: "BeforeArrival", IP: net.ParseIP("10.1.1.1")}, true},
+		{Orf{RawAction: "WhitelistRecipient", RawFilteringPoint: "OnArrival"}, true},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.want, rs.match(&tt.orf), "case #%d", i)
+	}
+	assert.True(t, ruleSet{}.match(&Orf{}), "no rules pass all")
+
+	rs = compileRules(Rules{Include: []Rule{{IPRange: "10.0.0.0/33"}}}, NopLogger)
+	assert.False(t, rs.match(&Orf{RawAction: "Reject", IP: net.ParseIP("10.1.1.1")}), "invalid include rule matches nothing")
+	rs = compileRules(Rules{Include: []Rule{{Sender: "[a"}, {Action: "Reject"}}}, NopLogger)
+	assert.True(t, rs.match(&Orf{RawAction: "Reject"}), "valid include rules still work")
+	assert.False(t, rs.match(&Orf{RawAction: "Accept"}))
+}
+
+func TestService_Rules(t *testing.T) {
+	svc := NewService(Opts{
+		LogPaths:  []string{"./test"},
+		Retention: 24 * 365 * 100 * time.Hour,
+		Rules:     Rules{Exclude: []Rule{{Recipient: "second@*"}}},
+	})
+
+	orfs := svc.GetLastRecords()
+	if !assert.Equal(t, 1, len(orfs)) {
+		return
+	}
+	assert.Equal(t, "first@recipient.com", orfs[0].Recipients)
+	assert.Equal(t, "Reject", orfs[0].RawAction)
+	assert.Equal(t, "BeforeArrival", orfs[0].RawFilteringPoint)
+	assert.Equal(t, 1, svc.DedupStats().Entries, "excluded record is not in dedup index")
+}
@@ -0,0 +1,178 @@
+package orflog
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Geo describes related IP of the record
+type Geo struct {
+	Country  string // ISO 3166-1 country code
+	ASN      uint
+	ASOrg    string
+	Private  bool // private network (RFC 1918, RFC 6598, unique local IPv6)
+	Reserved bool // loopback, link-local, multicast, documentation and other special ranges
+}
+
+// GeoOpts defines local MaxMind-format databases used to enrich records
+type GeoOpts struct {
+	CountryDB string `long:"country-db" env:"COUNTRY_DB" description:"path to GeoLite2/GeoIP2 Country or City .mmdb file"`
+	ASNDB     string `long:"asn-db" env:"ASN_DB" description:"path to GeoLite2/GeoIP2 ASN .mmdb file"`
+}
+
+// GeoIP looks up country and ASN of IP addresses in local databases, safe for concurrent use.
+// Databases are memory-mapped until Close.
+type GeoIP struct {
+	mu      sync.RWMutex
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// geoCountryRecord is the part of Country or City database record used by GeoIP
+type geoCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// geoASNRecord is ASN database record
+type geoASNRecord struct {
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "100::/64", "2001:db8::/32", "fe80::/10", "ff00::/8",
+)
+
+// NewGeoIP loads databases set in opts, empty path skips the database
+func NewGeoIP(opts GeoOpts) (*GeoIP, error) {
+	res := &GeoIP{}
+	var err error
+	if opts.CountryDB != "" {
+		if res.country, err = maxminddb.Open(opts.CountryDB); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ASNDB != "" {
+		if res.asn, err = maxminddb.Open(opts.ASNDB); err != nil {
+			_ = res.Close()
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Close releases databases, Lookup after Close returns range tags only
+func (g *GeoIP) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errs []string
+	for _, r := range []*maxminddb.Reader{g.country, g.asn} {
+		if r == nil {
+			continue
+		}
+		if err := r.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	g.country, g.asn = nil, nil
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Lookup returns country, ASN and range tags of ip, missing data is left empty
+func (g *GeoIP) Lookup(ip net.IP) Geo {
+	res := ipRangeTags(ip)
+	if ip == nil || res.Private || res.Reserved {
+		return res
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.country != nil {
+		var rec geoCountryRecord
+		if err := g.country.Lookup(ip, &rec); err == nil {
+			res.Country = rec.Country.ISOCode
+			if res.Country == "" {
+				res.Country = rec.RegisteredCountry.ISOCode
+			}
+		}
+	}
+	if g.asn != nil {
+		var rec geoASNRecord
+		if err := g.asn.Lookup(ip, &rec); err == nil {
+			res.ASN, res.ASOrg = rec.ASN, rec.ASOrg
+		}
+	}
+	return res
+}
+
+// Enrich fills Geo of the record
+func (g *GeoIP) Enrich(orf *Orf) {
+	orf.Geo = g.Lookup(orf.IP)
+}
+
+// Stage returns enrichment stage filling Geo of records
+func (g *GeoIP) Stage() Stage {
+	return Stage{Name: "geoip", Func: func(_ context.Context, orf *Orf) (bool, error) {
+		g.Enrich(orf)
+		return true, nil
+	}}
+}
+
+// parseIP parses related IP from the log, empty or invalid value gives nil
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 { // zone of link-local IPv6
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// ipRangeTags returns Geo with private and reserved flags of ip
+func ipRangeTags(ip net.IP) Geo {
+	var res Geo
+	if ip == nil {
+		return res
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			res.Private = true
+		}
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			res.Reserved = true
+		}
+	}
+	return res
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
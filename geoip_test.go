@@ -0,0 +1,229 @@
+package orflog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoIP(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	countryDB := filepath.Join(dir, "country.mmdb")
+	writeTestMMDB(t, countryDB, 6, map[string]interface{}{
+		"81.2.69.0/24":   map[string]interface{}{"country": map[string]interface{}{"iso_code": "GB"}},
+		"95.108.0.0/16":  map[string]interface{}{"country": map[string]interface{}{"iso_code": mmdbTestPointer("RU")}},
+		"2a02:6b8::/32":  map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "RU"}},
+		"198.51.99.0/24": map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}},
+	})
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, asnDB, 4, map[string]interface{}{
+		"95.108.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(13238), "autonomous_system_organization": "YANDEX LLC"},
+	})
+
+	geo, err := NewGeoIP(GeoOpts{CountryDB: countryDB, ASNDB: asnDB})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, Geo{Country: "GB"}, geo.Lookup(net.ParseIP("81.2.69.160")))
+	assert.Equal(t, Geo{Country: "RU", ASN: 13238, ASOrg: "YANDEX LLC"}, geo.Lookup(net.ParseIP("95.108.1.1")))
+	assert.Equal(t, Geo{Country: "RU"}, geo.Lookup(net.ParseIP("2a02:6b8::1")))
+	assert.Equal(t, Geo{}, geo.Lookup(net.ParseIP("8.8.8.8")))
+	assert.Equal(t, Geo{Private: true}, geo.Lookup(net.ParseIP("10.10.10.10")))
+	assert.Equal(t, Geo{Reserved: true}, geo.Lookup(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, Geo{}, geo.Lookup(nil))
+
+	assert.NoError(t, geo.Close())
+	assert.Equal(t, Geo{}, geo.Lookup(net.ParseIP("81.2.69.160")), "closed databases are not used")
+	assert.NoError(t, geo.Close())
+
+	_, err = NewGeoIP(GeoOpts{CountryDB: filepath.Join(dir, "nonexistent.mmdb")})
+	assert.Error(t, err)
+	_, err = NewGeoIP(GeoOpts{CountryDB: countryDB, ASNDB: filepath.Join(dir, "nonexistent.mmdb")})
+	assert.Error(t, err)
+
+	svc := NewService(Opts{NoChannel: true, GeoIP: GeoOpts{CountryDB: countryDB}, Logger: NopLogger})
+	if assert.NotNil(t, svc.geo) {
+		svc.CloseChannels()
+		assert.Nil(t, svc.geo.country, "released when the service terminated")
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	assert.Equal(t, net.ParseIP("10.10.10.10"), parseIP("10.10.10.10"))
+	assert.Equal(t, net.ParseIP("2001:db8::1"), parseIP("[2001:db8::1]"))
+	assert.Equal(t, net.ParseIP("fe80::1"), parseIP("fe80::1%eth0"))
+	assert.Nil(t, parseIP(""))
+	assert.Nil(t, parseIP("unknown"))
+}
+
+// MaxMind DB data types used by the test writer
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbArray   = 11
+)
+
+// mmdbTestPointer is written as pointer to the string stored before the tree data
+type mmdbTestPointer string
+
+// writeTestMMDB writes MaxMind DB with 24 bit records for networks
+func writeTestMMDB(t *testing.T, path string, ipVersion int, networks map[string]interface{}) {
+	type node struct{ rec [2]int } // >= 0 - node, -1 - empty, <= -2 - data index
+	nodes := []node{{rec: [2]int{-1, -1}}}
+
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	var data bytes.Buffer
+	pointers := map[mmdbTestPointer]int{}
+	for _, v := range networks {
+		collectTestPointers(v, pointers, &data)
+	}
+
+	dataOffsets := make([]int, 0, len(cidrs))
+	for i, cidr := range cidrs {
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		if ipVersion == 6 {
+			if ip4 := ip.To4(); ip4 != nil { // IPv4 networks are in ::/96
+				ones += 96
+				ip = append(make(net.IP, 12), ip4...)
+			}
+		} else {
+			ip = ip.To4()
+		}
+
+		dataOffsets = append(dataOffsets, data.Len())
+		encodeTestMMDB(&data, networks[cidr], pointers)
+
+		cur := 0
+		for b := 0; b < ones; b++ {
+			bit := int(ip[b/8]>>(7-uint(b%8))) & 1
+			if b == ones-1 {
+				nodes[cur].rec[bit] = -2 - i
+				break
+			}
+			if nodes[cur].rec[bit] < 0 {
+				nodes = append(nodes, node{rec: [2]int{-1, -1}})
+				nodes[cur].rec[bit] = len(nodes) - 1
+			}
+			cur = nodes[cur].rec[bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, r := range n.rec {
+			v := len(nodes) // empty
+			if r >= 0 {
+				v = r
+			}
+			if r <= -2 {
+				v = len(nodes) + 16 + dataOffsets[-2-r]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encodeTestMMDB(&buf, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+	}, nil)
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func collectTestPointers(v interface{}, pointers map[mmdbTestPointer]int, data *bytes.Buffer) {
+	switch val := v.(type) {
+	case mmdbTestPointer:
+		if _, ok := pointers[val]; !ok {
+			pointers[val] = data.Len()
+			encodeTestMMDB(data, string(val), nil)
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			collectTestPointers(item, pointers, data)
+		}
+	}
+}
+
+func encodeTestMMDB(buf *bytes.Buffer, v interface{}, pointers map[mmdbTestPointer]int) {
+	ctrl := func(typ, size int) {
+		sizeBits, ext := size, []byte(nil)
+		if size >= 29 { // test values are shorter than 285
+			sizeBits, ext = 29, []byte{byte(size - 29)}
+		}
+		if typ > 7 {
+			buf.Write([]byte{byte(sizeBits), byte(typ - 7)})
+		} else {
+			buf.WriteByte(byte(typ<<5 | sizeBits))
+		}
+		buf.Write(ext)
+	}
+	uintBytes := func(u uint64) []byte {
+		var b []byte
+		for ; u > 0; u >>= 8 {
+			b = append([]byte{byte(u)}, b...)
+		}
+		return b
+	}
+
+	switch val := v.(type) {
+	case mmdbTestPointer:
+		p := pointers[val]
+		buf.Write([]byte{byte(mmdbPointer<<5 | (p>>8)&0x7), byte(p)}) // short pointer, test data is small
+	case string:
+		ctrl(mmdbString, len(val))
+		buf.WriteString(val)
+	case uint16:
+		b := uintBytes(uint64(val))
+		ctrl(mmdbUint16, len(b))
+		buf.Write(b)
+	case uint32:
+		b := uintBytes(uint64(val))
+		ctrl(mmdbUint32, len(b))
+		buf.Write(b)
+	case []interface{}:
+		ctrl(mmdbArray, len(val))
+		for _, item := range val {
+			encodeTestMMDB(buf, item, pointers)
+		}
+	case map[string]interface{}:
+		ctrl(mmdbMap, len(val))
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeTestMMDB(buf, k, pointers)
+			encodeTestMMDB(buf, val[k], pointers)
+		}
+	}
+}
@@ -3,6 +3,9 @@ module github.com/zorion79/orflog/v3
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/go-pkgz/lgr v0.6.3
+	github.com/oschwald/maxminddb-golang v1.5.0
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 )
@@ -0,0 +1,589 @@
+package orflog
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Index is on-disk inverted index of Message, Sender and Recipients of records. Every Add writes
+// an immutable segment file, Merge joins segments of similar size and Compact merges all of them.
+// Segment file is a gob stream of indexHeader followed by postings and then records, so segments
+// can be listed without reading postings, and records are read only for segments with matches.
+// Version 1 segments have postings and records in one indexSegment value. Safe for concurrent use.
+type Index struct {
+	dir    string
+	logger Logger
+
+	mu       sync.RWMutex
+	segments []indexHeader // in order of seq
+	seq      uint64        // seq of the last written segment
+}
+
+// indexHeader describes segment file
+type indexHeader struct {
+	Version int
+	Seq     uint64
+	Min     time.Time // time of the earliest record
+	Max     time.Time // time of the latest record
+	Docs    int
+}
+
+// indexSegment keeps records and postings of their terms
+type indexSegment struct {
+	Docs  []Orf
+	Terms map[string][]indexPosting
+}
+
+// indexPosting is occurrence of the term in the field of the record
+type indexPosting struct {
+	Doc       int32
+	Field     uint8
+	Positions []int32
+}
+
+// indexed fields
+const (
+	indexMessage uint8 = iota
+	indexSender
+	indexRecipients
+)
+
+const (
+	indexVersion     = 2
+	indexVersionV1   = 1 // postings and records in one value, still readable
+	indexSuffix      = ".seg"
+	indexMergeFactor = 4 // segments of one size tier merged together, tier size grows by this factor
+)
+
+var indexFields = map[string]uint8{"message": indexMessage, "sender": indexSender, "recipients": indexRecipients}
+
+// ErrIndexDisabled returned by Search if IndexDir is not set
+var ErrIndexDisabled = errors.New("full-text index is disabled")
+
+// OpenIndex opens index in dir, creating dir if needed
+func OpenIndex(dir string) (*Index, error) {
+	return openIndex(dir, defaultLogger)
+}
+
+// openIndex opens index logging to logger
+func openIndex(dir string, logger Logger) (*Index, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+indexSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Index{dir: dir, logger: logger}
+	for _, file := range files {
+		hdr, err := readIndexHeader(file)
+		if err != nil {
+			logger.Warn("index segment skipped", "path", file, "error", err)
+			continue
+		}
+		res.segments = append(res.segments, hdr)
+		if hdr.Seq > res.seq {
+			res.seq = hdr.Seq
+		}
+	}
+	sort.Slice(res.segments, func(i, j int) bool { return res.segments[i].Seq < res.segments[j].Seq })
+	return res, nil
+}
+
+// Add writes records to a new segment
+func (x *Index) Add(orfs ...Orf) error {
+	if len(orfs) == 0 {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.write(orfs)
+}
+
+// Search returns records matching all clauses of the query in time order. Clause is a term (invoice),
+// prefix (inv*) or phrase in quotes ("invoice.pdf"), optionally limited to the field: message:, sender:
+// or recipients:. Terms are lowercase runs of letters and digits, so invoice.pdf is a phrase of two terms.
+func (x *Index) Search(query string) ([]Orf, error) {
+	return x.SearchRange(query, time.Time{}, time.Time{})
+}
+
+// SearchRange returns records with time in [from, to] matching the query, see Search. Zero from or to
+// is not limiting. Segments outside of the range are not read.
+func (x *Index) SearchRange(query string, from, to time.Time) ([]Orf, error) {
+	clauses, err := parseIndexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	result := make([]Orf, 0)
+	for _, hdr := range x.segments {
+		if !from.IsZero() && hdr.Max.Before(from) || !to.IsZero() && hdr.Min.After(to) {
+			continue
+		}
+		orfs, err := x.search(hdr, clauses)
+		if err != nil {
+			return nil, err
+		}
+		for _, orf := range orfs {
+			if !from.IsZero() && orf.Time.Before(from) || !to.IsZero() && orf.Time.After(to) {
+				continue
+			}
+			result = append(result, orf)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+// Expire removes segments with all records before from and returns number of removed segments.
+// Segments with some of records before from are cleaned by Merge or Compact.
+func (x *Index) Expire(from time.Time) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	keep := x.segments[:0]
+	removed := 0
+	var errs []string
+	for _, hdr := range x.segments {
+		if !hdr.Max.Before(from) {
+			keep = append(keep, hdr)
+			continue
+		}
+		if err := os.Remove(x.path(hdr.Seq)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+			keep = append(keep, hdr)
+			continue
+		}
+		removed++
+	}
+	x.segments = keep
+	if len(errs) > 0 {
+		return removed, errors.New(strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
+
+// Compact merges all segments into one, dropping records before from and duplicates
+func (x *Index) Compact(from time.Time) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.segments) == 0 {
+		return nil
+	}
+	return x.merge(x.segments, from)
+}
+
+// Merge joins runs of indexMergeFactor neighbour segments of one size tier, so every record is
+// rewritten about log(records) times instead of every compaction, and the large old segments are
+// left alone by small new ones. Segment with more than half of its time range before from is
+// rewritten without those records. Returns number of merges.
+func (x *Index) Merge(from time.Time) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	merges := 0
+	for {
+		group := x.mergeGroup(from)
+		if len(group) == 0 {
+			return merges, nil
+		}
+		if err := x.merge(group, from); err != nil {
+			return merges, err
+		}
+		merges++
+	}
+}
+
+// mergeGroup returns segments to merge next, must be called under lock
+func (x *Index) mergeGroup(from time.Time) []indexHeader {
+	byTime := make([]indexHeader, len(x.segments))
+	copy(byTime, x.segments)
+	sort.SliceStable(byTime, func(i, j int) bool { return byTime[i].Min.Before(byTime[j].Min) })
+
+	for _, hdr := range byTime {
+		if hdr.Min.Before(from) && from.Sub(hdr.Min) > hdr.Max.Sub(from) {
+			return []indexHeader{hdr}
+		}
+	}
+
+	tier := func(docs int) int {
+		res := 0
+		for ; docs >= indexMergeFactor; docs /= indexMergeFactor {
+			res++
+		}
+		return res
+	}
+	start := 0
+	for i := range byTime {
+		if tier(byTime[i].Docs) != tier(byTime[start].Docs) {
+			start = i
+		}
+		if i-start+1 == indexMergeFactor {
+			return byTime[start : i+1]
+		}
+	}
+	return nil
+}
+
+// merge replaces segments of group with one segment, dropping records before from and duplicates,
+// must be called under lock
+func (x *Index) merge(group []indexHeader, from time.Time) error {
+	merged := make(map[uint64]bool, len(group))
+	seen := make(map[string]bool)
+	docs := make([]Orf, 0)
+	for _, hdr := range group {
+		merged[hdr.Seq] = true
+		seg, err := x.read(hdr)
+		if err != nil {
+			return err
+		}
+		for _, orf := range seg.Docs {
+			if orf.Time.Before(from) || seen[orf.HashString] {
+				continue
+			}
+			seen[orf.HashString] = true
+			docs = append(docs, orf)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].Time.Before(docs[j].Time) })
+
+	old := x.segments
+	x.segments = make([]indexHeader, 0, len(old))
+	for _, hdr := range old {
+		if !merged[hdr.Seq] {
+			x.segments = append(x.segments, hdr)
+		}
+	}
+	if len(docs) > 0 {
+		if err := x.write(docs); err != nil {
+			x.segments = old
+			return err
+		}
+	}
+	for _, hdr := range group {
+		if err := os.Remove(x.path(hdr.Seq)); err != nil && !os.IsNotExist(err) {
+			x.logger.Warn("could not remove index segment", "error", err)
+		}
+	}
+	return nil
+}
+
+// Segments returns number of segments
+func (x *Index) Segments() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.segments)
+}
+
+// write makes segment of records, must be called under lock. File is written to temporary name
+// and renamed, so readers never see partial segments.
+func (x *Index) write(orfs []Orf) error {
+	seg := newIndexSegment(orfs)
+	hdr := indexHeader{Version: indexVersion, Seq: x.seq + 1, Min: orfs[0].Time, Max: orfs[0].Time, Docs: len(orfs)}
+	for _, orf := range orfs {
+		if orf.Time.Before(hdr.Min) {
+			hdr.Min = orf.Time
+		}
+		if orf.Time.After(hdr.Max) {
+			hdr.Max = orf.Time
+		}
+	}
+
+	tmp, err := ioutil.TempFile(x.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(tmp)
+	if err = enc.Encode(hdr); err == nil {
+		err = enc.Encode(seg.Terms)
+	}
+	if err == nil {
+		err = enc.Encode(seg.Docs)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), x.path(hdr.Seq))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write index segment: %v", err)
+	}
+
+	x.seq = hdr.Seq
+	x.segments = append(x.segments, hdr)
+	return nil
+}
+
+// read loads segment, must be called under lock
+func (x *Index) read(hdr indexHeader) (indexSegment, error) {
+	return x.load(hdr, func(indexSegment) bool { return true })
+}
+
+// search returns records of the segment matching clauses, records are read only if postings match,
+// must be called under lock
+func (x *Index) search(hdr indexHeader, clauses []indexClause) ([]Orf, error) {
+	var docs map[int32]bool
+	seg, err := x.load(hdr, func(seg indexSegment) bool {
+		docs = seg.matchAll(clauses)
+		return len(docs) > 0
+	})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	result := make([]Orf, 0, len(docs))
+	for doc := range docs {
+		if int(doc) < len(seg.Docs) {
+			result = append(result, seg.Docs[doc])
+		}
+	}
+	return result, nil
+}
+
+// load reads postings of the segment and its records if docs returns true for postings,
+// must be called under lock
+func (x *Index) load(hdr indexHeader, docs func(seg indexSegment) bool) (indexSegment, error) {
+	var seg indexSegment
+	f, err := os.Open(x.path(hdr.Seq))
+	if err != nil {
+		return seg, err
+	}
+	defer f.Close() //nolint:errcheck
+	dec := gob.NewDecoder(f)
+	var h indexHeader
+	if err = dec.Decode(&h); err == nil {
+		if h.Version == indexVersionV1 {
+			if err = dec.Decode(&seg); err == nil {
+				docs(seg)
+			}
+		} else if err = dec.Decode(&seg.Terms); err == nil && docs(seg) {
+			err = dec.Decode(&seg.Docs)
+		}
+	}
+	if err != nil {
+		return seg, fmt.Errorf("could not read index segment %d: %v", hdr.Seq, err)
+	}
+	return seg, nil
+}
+
+func (x *Index) path(seq uint64) string {
+	return filepath.Join(x.dir, fmt.Sprintf("%016x%s", seq, indexSuffix))
+}
+
+func readIndexHeader(path string) (indexHeader, error) {
+	var hdr indexHeader
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return hdr, err
+	}
+	defer f.Close() //nolint:errcheck
+	if err = gob.NewDecoder(f).Decode(&hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return hdr, err
+	}
+	if hdr.Version != indexVersion && hdr.Version != indexVersionV1 {
+		return hdr, fmt.Errorf("unsupported version %d", hdr.Version)
+	}
+	return hdr, nil
+}
+
+func newIndexSegment(orfs []Orf) indexSegment {
+	seg := indexSegment{Docs: orfs, Terms: make(map[string][]indexPosting)}
+	for doc, orf := range orfs {
+		for field, text := range [...]string{indexMessage: orf.Message, indexSender: orf.Sender, indexRecipients: orf.Recipients} {
+			positions := make(map[string][]int32)
+			terms := make([]string, 0)
+			for pos, term := range indexTerms(text) {
+				if _, ok := positions[term]; !ok {
+					terms = append(terms, term)
+				}
+				positions[term] = append(positions[term], int32(pos))
+			}
+			for _, term := range terms {
+				seg.Terms[term] = append(seg.Terms[term], indexPosting{Doc: int32(doc), Field: uint8(field), Positions: positions[term]})
+			}
+		}
+	}
+	return seg
+}
+
+// indexTerms splits text to lowercase runs of letters and digits
+func indexTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexClause is a phrase of one or more terms, the last term is a prefix if prefix set
+type indexClause struct {
+	field  int // -1 for any field
+	terms  []string
+	prefix bool
+}
+
+// parseIndexQuery splits query to clauses
+func parseIndexQuery(query string) ([]indexClause, error) {
+	var result []indexClause
+	rest := strings.TrimSpace(query)
+	for rest != "" {
+		clause := indexClause{field: -1}
+		if i := strings.IndexAny(rest, ":\" "); i > 0 && rest[i] == ':' {
+			field, ok := indexFields[strings.ToLower(rest[:i])]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", rest[:i])
+			}
+			clause.field = int(field)
+			rest = rest[i+1:]
+		}
+
+		var text string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, errors.New("unterminated phrase")
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ' ')
+			if end < 0 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+			clause.prefix = strings.HasSuffix(text, "*")
+		}
+		rest = strings.TrimSpace(rest)
+
+		clause.terms = indexTerms(text)
+		if len(clause.terms) == 0 {
+			continue
+		}
+		result = append(result, clause)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("empty query")
+	}
+	return result, nil
+}
+
+// matchAll returns records matching all clauses
+func (seg indexSegment) matchAll(clauses []indexClause) map[int32]bool {
+	var docs map[int32]bool
+	for _, c := range clauses {
+		matched := seg.match(c)
+		if docs != nil {
+			for doc := range docs {
+				if !matched[doc] {
+					delete(docs, doc)
+				}
+			}
+		} else {
+			docs = matched
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+	}
+	return docs
+}
+
+// match returns records matching the clause
+func (seg indexSegment) match(c indexClause) map[int32]bool {
+	type occurrence struct {
+		doc   int32
+		field uint8
+		pos   int32
+	}
+
+	// occurrences of every clause term, the last one expanded by prefix
+	occurrences := make([]map[occurrence]bool, len(c.terms))
+	for i, term := range c.terms {
+		occurrences[i] = make(map[occurrence]bool)
+		postings := seg.Terms[term]
+		if c.prefix && i == len(c.terms)-1 {
+			postings = nil
+			for t, p := range seg.Terms {
+				if strings.HasPrefix(t, term) {
+					postings = append(postings, p...)
+				}
+			}
+		}
+		for _, p := range postings {
+			if c.field >= 0 && int(p.Field) != c.field {
+				continue
+			}
+			for _, pos := range p.Positions {
+				occurrences[i][occurrence{doc: p.Doc, field: p.Field, pos: pos}] = true
+			}
+		}
+	}
+
+	result := make(map[int32]bool)
+	for first := range occurrences[0] {
+		phrase := true
+		for i := 1; i < len(occurrences) && phrase; i++ {
+			phrase = occurrences[i][occurrence{doc: first.doc, field: first.field, pos: first.pos + int32(i)}]
+		}
+		if phrase {
+			result[first.doc] = true
+		}
+	}
+	return result
+}
+
+// Search finds records in the full-text index, see Index.Search for the query syntax.
+// Index keeps records sent by the service within the Window.
+func (s *Service) Search(query string) ([]Orf, error) {
+	return s.SearchRange(query, time.Time{}, time.Time{})
+}
+
+// SearchRange finds records with time in [from, to] in the full-text index, see Index.SearchRange.
+// Records before the window start, still kept by not merged segments, are not returned.
+func (s *Service) SearchRange(query string, from, to time.Time) ([]Orf, error) {
+	if s.index == nil {
+		return nil, ErrIndexDisabled
+	}
+	s.mu.RLock()
+	windowFrom := s.window.from
+	s.mu.RUnlock()
+	if from.Before(windowFrom) {
+		from = windowFrom
+	}
+	return s.index.SearchRange(query, from, to)
+}
+
+// updateIndex adds sent records to the index and drops records before from
+func (s *Service) updateIndex(orfs []*Orf, from time.Time) {
+	if s.index == nil {
+		return
+	}
+	records := make([]Orf, 0, len(orfs))
+	for _, orf := range orfs {
+		records = append(records, *orf)
+	}
+	if err := s.index.Add(records...); err != nil {
+		s.Logger.Warn("could not index records", "records", len(records), "error", err)
+	}
+	if _, err := s.index.Expire(from); err != nil {
+		s.Logger.Warn("could not expire index segments", "error", err)
+	}
+	if _, err := s.index.Merge(from); err != nil {
+		s.Logger.Warn("could not merge index segments", "error", err)
+	}
+}
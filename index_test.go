@@ -0,0 +1,206 @@
+package orflog
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	idx, err := OpenIndex(filepath.Join(dir, "index"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, idx.Add(
+		Orf{Time: start, Sender: "<boss@example.com>", Recipients: "ann@example.com", Message: "Attachment blocked: invoice.pdf", HashString: "1"},
+		Orf{Time: start.Add(time.Hour), Sender: "<spam@spam.com>", Recipients: "bob@example.com", Message: "Keyword filter: invoice", HashString: "2"},
+	))
+	assert.NoError(t, idx.Add(Orf{Time: start.Add(2 * time.Hour), Sender: "<ann@example.com>", Recipients: "boss@example.com", Message: "Греylisting: повтор", HashString: "3"}))
+	assert.NoError(t, idx.Add())
+	assert.Equal(t, 2, idx.Segments())
+
+	hashes := func(query string) []string {
+		orfs, err := idx.Search(query)
+		assert.NoError(t, err, query)
+		res := make([]string, 0, len(orfs))
+		for _, orf := range orfs {
+			res = append(res, orf.HashString)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"1", "2"}, hashes("invoice"))
+	assert.Equal(t, []string{"1"}, hashes(`"invoice.pdf"`))
+	assert.Equal(t, []string{"1"}, hashes("INVOICE.PDF"), "unquoted term with dot is a phrase")
+	assert.Equal(t, []string{"1", "2"}, hashes("inv*"))
+	assert.Equal(t, []string{"1", "3"}, hashes("sender:example.com"))
+	assert.Equal(t, []string{"3"}, hashes("recipients:boss"))
+	assert.Equal(t, []string{"2"}, hashes("invoice sender:spam*"))
+	assert.Equal(t, []string{"3"}, hashes("повт*"))
+	assert.Equal(t, []string{}, hashes(`"pdf invoice"`))
+
+	for _, query := range []string{"", "subject:invoice", `"invoice`} {
+		_, err = idx.Search(query)
+		assert.Error(t, err, query)
+	}
+
+	reopened, err := OpenIndex(filepath.Join(dir, "index"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, reopened.Segments())
+	assert.NoError(t, reopened.Add(Orf{Time: start.Add(3 * time.Hour), Message: "invoice", HashString: "4"}))
+	assert.NoError(t, reopened.Compact(start.Add(30*time.Minute)))
+	assert.Equal(t, 1, reopened.Segments())
+	orfs, err := reopened.Search("invoice")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(orfs)) {
+		assert.Equal(t, "2", orfs[0].HashString)
+		assert.Equal(t, "4", orfs[1].HashString)
+	}
+
+	removed, err := reopened.Expire(start.Add(4 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	files, _ := filepath.Glob(filepath.Join(dir, "index", "*"))
+	assert.Empty(t, files)
+}
+
+func TestIndex_SearchRange(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	idx, err := OpenIndex(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	first := Orf{Time: start, Message: "invoice", HashString: "1"}
+	assert.NoError(t, idx.Add(first))
+	assert.NoError(t, idx.Add(Orf{Time: start.Add(2 * time.Hour), Message: "invoice", HashString: "2"}))
+
+	// the first segment lost its records, postings are intact
+	f, err := os.Create(idx.path(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc := gob.NewEncoder(f)
+	assert.NoError(t, enc.Encode(idx.segments[0]))
+	assert.NoError(t, enc.Encode(newIndexSegment([]Orf{first}).Terms))
+	assert.NoError(t, f.Close())
+
+	orfs, err := idx.SearchRange("invoice", start.Add(time.Hour), time.Time{})
+	assert.NoError(t, err, "segment before the range is not read")
+	if assert.Equal(t, 1, len(orfs)) {
+		assert.Equal(t, "2", orfs[0].HashString)
+	}
+	orfs, err = idx.SearchRange("invoice", start.Add(time.Hour), start.Add(90*time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, orfs)
+	orfs, err = idx.Search("nothing")
+	assert.NoError(t, err, "records are not read without matches")
+	assert.Empty(t, orfs)
+	_, err = idx.Search("invoice")
+	assert.Error(t, err)
+
+	// version 1 segment has postings and records in one value
+	f, err = os.Create(idx.path(3))
+	if !assert.NoError(t, err) {
+		return
+	}
+	v1 := Orf{Time: start.Add(3 * time.Hour), Message: "old invoice", HashString: "3"}
+	enc = gob.NewEncoder(f)
+	assert.NoError(t, enc.Encode(indexHeader{Version: indexVersionV1, Seq: 3, Min: v1.Time, Max: v1.Time, Docs: 1}))
+	assert.NoError(t, enc.Encode(newIndexSegment([]Orf{v1})))
+	assert.NoError(t, f.Close())
+	reopened, err := OpenIndex(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	orfs, err = reopened.SearchRange("old", start.Add(time.Hour), time.Time{})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(orfs)) {
+		assert.Equal(t, "3", orfs[0].HashString)
+	}
+}
+
+func TestIndex_Merge(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	idx, err := OpenIndex(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	add := func(i int) {
+		assert.NoError(t, idx.Add(Orf{Time: start.Add(time.Duration(i) * time.Minute), Message: "invoice", HashString: strconv.Itoa(i)}))
+	}
+	for i := 0; i < 3; i++ {
+		add(i)
+	}
+	merges, err := idx.Merge(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, merges, "less than indexMergeFactor segments of one size")
+
+	add(3)
+	merges, err = idx.Merge(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, merges)
+	assert.Equal(t, 1, idx.Segments())
+	base := idx.segments[0]
+	assert.Equal(t, 4, base.Docs)
+
+	// small segments are merged together, the large one is not rewritten
+	for i := 4; i < 15; i++ {
+		add(i)
+		_, err = idx.Merge(time.Time{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 6, idx.Segments(), "three segments of 4 records and three of 1")
+	assert.Equal(t, base, idx.segments[0])
+	for i := 15; i < 17; i++ {
+		add(i)
+		_, err = idx.Merge(time.Time{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, idx.Segments())
+	assert.Equal(t, 16, idx.segments[0].Docs)
+	orfs, err := idx.Search("invoice")
+	assert.NoError(t, err)
+	assert.Equal(t, 17, len(orfs))
+
+	// segment mostly before from is rewritten without old records
+	merges, err = idx.Merge(start.Add(10 * time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, merges)
+	orfs, err = idx.Search("invoice")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(orfs))
+	assert.Equal(t, "10", orfs[0].HashString)
+}
+
+func TestService_Search(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	svc := NewService(Opts{LogPaths: []string{"./test"}})
+	_, err := svc.Search("message")
+	assert.Equal(t, ErrIndexDisabled, err)
+
+	svc = NewService(Opts{LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour, IndexDir: dir})
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+	orfs, err := svc.Search(`"long message" recipients:second*`)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(orfs)) {
+		assert.Equal(t, "second@recipient.com", orfs[0].Recipients)
+	}
+}
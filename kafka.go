@@ -0,0 +1,137 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KafkaOpts defines Kafka REST Proxy and topic
+type KafkaOpts struct {
+	URL      string        `long:"url" env:"URL" default:"http://127.0.0.1:8082" description:"Kafka REST Proxy url"`
+	Topic    string        `long:"topic" env:"TOPIC" default:"orflog-records" description:"topic of published records"`
+	User     string        `long:"user" env:"USER" description:"user of basic auth"`
+	Password string        `long:"password" env:"PASSWORD" description:"password of basic auth"`
+	Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"timeout of publish request"`
+
+	Client *http.Client `no-flag:"true"` // http.Client with Timeout by default
+}
+
+// KafkaTransport publishes messages to Kafka topic via REST Proxy API v2 with binary embedded format.
+// Record hash is the message key, so Kafka partitions records by hash. Publish is acknowledged when
+// proxy returned offsets for all messages.
+type KafkaTransport struct {
+	KafkaOpts
+}
+
+// kafkaRecord is a record of produce request with base64 key and value
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// kafkaResponse is produce response
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+	Message string `json:"message"`
+}
+
+const (
+	kafkaURL         = "http://127.0.0.1:8082"
+	kafkaTopic       = "orflog-records"
+	kafkaTimeout     = 30 * time.Second
+	kafkaContentType = "application/vnd.kafka.binary.v2+json"
+)
+
+// NewKafkaTransport makes transport with defaults for empty opts
+func NewKafkaTransport(opts KafkaOpts) *KafkaTransport {
+	if opts.URL == "" {
+		opts.URL = kafkaURL
+	}
+	if opts.Topic == "" {
+		opts.Topic = kafkaTopic
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = kafkaTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	return &KafkaTransport{KafkaOpts: opts}
+}
+
+// Publish produces messages to topic
+func (k *KafkaTransport) Publish(ctx context.Context, msgs []BusMessage) error {
+	records := make([]kafkaRecord, 0, len(msgs))
+	for _, msg := range msgs {
+		records = append(records, kafkaRecord{
+			Key:   base64.StdEncoding.EncodeToString([]byte(msg.Key)),
+			Value: base64.StdEncoding.EncodeToString(msg.Value),
+		})
+	}
+	body, err := json.Marshal(struct {
+		Records []kafkaRecord `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(k.URL, "/")+"/topics/"+url.PathEscape(k.Topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if k.User != "" {
+		req.SetBasicAuth(k.User, k.Password)
+	}
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+
+	var result kafkaResponse
+	if resp.StatusCode != http.StatusOK {
+		if json.Unmarshal(data, &result) == nil && result.Message != "" {
+			return fmt.Errorf("kafka proxy responded %s: %s", resp.Status, result.Message)
+		}
+		return fmt.Errorf("kafka proxy responded %s", resp.Status)
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("invalid kafka proxy response: %v", err)
+	}
+	if len(result.Offsets) != len(msgs) {
+		return fmt.Errorf("kafka proxy acknowledged %d of %d messages", len(result.Offsets), len(msgs))
+	}
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil || o.Error != "" {
+			return fmt.Errorf("kafka proxy could not produce message: %s", o.Error)
+		}
+	}
+	return nil
+}
+
+// Close does nothing, requests don't keep state
+func (k *KafkaTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package orflog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaTransport(t *testing.T) {
+	var produced []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/orf-events" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40401,"message":"Topic not found."}`))
+			return
+		}
+		assert.Equal(t, "application/vnd.kafka.binary.v2+json", r.Header.Get("Content-Type"))
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "user:secret", user+":"+password)
+
+		var req struct {
+			Records []kafkaRecord `json:"records"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		resp := `{"offsets":[`
+		for i, rec := range req.Records {
+			key, _ := base64.StdEncoding.DecodeString(rec.Key)
+			value, _ := base64.StdEncoding.DecodeString(rec.Value)
+			if i > 0 {
+				resp += ","
+			}
+			if string(value) == "fail" {
+				resp += `{"partition":null,"offset":null,"error_code":50002,"error":"not enough replicas"}`
+				continue
+			}
+			produced = append(produced, string(key)+"="+string(value))
+			resp += `{"partition":0,"offset":1,"error_code":null,"error":null}`
+		}
+		_, _ = w.Write([]byte(resp + "]}"))
+	}))
+	defer ts.Close()
+
+	k := NewKafkaTransport(KafkaOpts{URL: ts.URL + "/", Topic: "orf-events", User: "user", Password: "secret"})
+	assert.NoError(t, k.Publish(context.Background(), []BusMessage{{Key: "h1", Value: []byte("first")}, {Key: "h2", Value: []byte("second")}}))
+	assert.Equal(t, []string{"h1=first", "h2=second"}, produced)
+
+	err := k.Publish(context.Background(), []BusMessage{{Key: "h3", Value: []byte("fail")}})
+	assert.EqualError(t, err, "kafka proxy could not produce message: not enough replicas")
+
+	k.Topic = "missing"
+	err = k.Publish(context.Background(), nil)
+	assert.EqualError(t, err, "kafka proxy responded 404 Not Found: Topic not found.")
+	assert.NoError(t, k.Close())
+}
@@ -0,0 +1,61 @@
+package orflog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-pkgz/lgr"
+)
+
+// Logger receives leveled messages with structured fields, fields are alternating keys and values.
+// *slog.Logger satisfies it as is.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// NopLogger discards everything
+var NopLogger Logger = nopLogger{}
+
+// defaultLogger writes to the global lgr logger, which drops debug messages unless lgr.Debug is set up
+var defaultLogger = NewLgrLogger(nil)
+
+// NewLgrLogger makes Logger writing "[LEVEL] msg key=value ..." lines to l, global lgr logger if l is nil
+func NewLgrLogger(l lgr.L) Logger {
+	if l == nil {
+		l = lgr.Func(lgr.Printf)
+	}
+	return lgrLogger{l: l}
+}
+
+type lgrLogger struct{ l lgr.L }
+
+func (g lgrLogger) Debug(msg string, fields ...interface{}) { g.log("DEBUG", msg, fields) }
+func (g lgrLogger) Info(msg string, fields ...interface{})  { g.log("INFO", msg, fields) }
+func (g lgrLogger) Warn(msg string, fields ...interface{})  { g.log("WARN", msg, fields) }
+func (g lgrLogger) Error(msg string, fields ...interface{}) { g.log("ERROR", msg, fields) }
+
+func (g lgrLogger) log(level, msg string, fields []interface{}) {
+	var b strings.Builder
+	b.WriteString("[" + level + "] " + msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fmt.Sprint(fields[i]), "!MISSING"
+		if i+1 < len(fields) {
+			value = fmt.Sprint(fields[i+1])
+		}
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+	g.l.Logf("%s", b.String())
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,16 @@
+//go:build go1.21
+// +build go1.21
+
+package orflog
+
+import "log/slog"
+
+var _ Logger = (*slog.Logger)(nil)
+
+// NewSlogLogger makes Logger of l, slog.Default() if l is nil
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
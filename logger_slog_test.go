@@ -0,0 +1,26 @@
+//go:build go1.21
+// +build go1.21
+
+package orflog
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	svc := NewService(Opts{LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour, Logger: l})
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+	assert.Equal(t, "", buf.String(), "per-cycle details are debug")
+
+	l.Warn("could not read file", "path", "a.log")
+	assert.True(t, strings.HasSuffix(buf.String(), `level=WARN msg="could not read file" path=a.log`+"\n"), buf.String())
+	assert.NotNil(t, NewSlogLogger(nil))
+}
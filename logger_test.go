@@ -0,0 +1,62 @@
+package orflog
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger keeps "LEVEL msg" lines
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) Debug(msg string, fields ...interface{}) { r.add("DEBUG", msg, fields) }
+func (r *recordingLogger) Info(msg string, fields ...interface{})  { r.add("INFO", msg, fields) }
+func (r *recordingLogger) Warn(msg string, fields ...interface{})  { r.add("WARN", msg, fields) }
+func (r *recordingLogger) Error(msg string, fields ...interface{}) { r.add("ERROR", msg, fields) }
+
+func (r *recordingLogger) add(level, msg string, fields []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf("%s %s %v", level, msg, fields))
+}
+
+func TestNewLgrLogger(t *testing.T) {
+	var lines []string
+	l := NewLgrLogger(lgr.Func(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}))
+
+	l.Debug("records found", "cycle", 1, "new", 2)
+	l.Info("service terminated")
+	l.Warn("could not read file", "path", "c:/orf logs/a.log", "error", fmt.Errorf("access denied"))
+	l.Error("odd", "key")
+	assert.Equal(t, []string{
+		"[DEBUG] records found cycle=1 new=2",
+		"[INFO] service terminated",
+		`[WARN] could not read file path="c:/orf logs/a.log" error="access denied"`,
+		"[ERROR] odd key=!MISSING",
+	}, lines)
+
+	NopLogger.Warn("dropped", "key", "value")
+}
+
+func TestService_Logger(t *testing.T) {
+	rec := &recordingLogger{}
+	svc := NewService(Opts{LogPaths: []string{"./test", "./not-exists"}, Retention: 24 * 365 * 100 * time.Hour,
+		Encoding: "koi8-r", Logger: rec})
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+
+	assert.Equal(t, []string{
+		"WARN unsupported encoding, default used [encoding koi8-r default auto]",
+		"WARN could not open directory [source ./not-exists path ./not-exists error open ./not-exists: no such file or directory]",
+		"DEBUG log files scanned [files 1 lines 1 records 2]",
+		"DEBUG records found [cycle 1 scanned 2 new 2]",
+	}, rec.lines)
+}
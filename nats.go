@@ -0,0 +1,327 @@
+package orflog
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSOpts defines NATS server and subjects
+type NATSOpts struct {
+	Address    string        `long:"address" env:"ADDRESS" default:"127.0.0.1:4222" description:"NATS server host:port"`
+	Subject    string        `long:"subject" env:"SUBJECT" default:"orflog.records" description:"subject of published records, must be bound to JetStream stream"`
+	Partitions int           `long:"partitions" env:"PARTITIONS" description:"publish to subject.N where N is derived from record hash, single subject if 0"`
+	User       string        `long:"user" env:"USER" description:"user name"`
+	Password   string        `long:"password" env:"PASSWORD" description:"user password"`
+	Token      string        `long:"token" env:"TOKEN" description:"auth token"`
+	Timeout    time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"timeout of connect and publish"`
+
+	TLSConfig *tls.Config `no-flag:"true"` // used if server requires TLS
+}
+
+// NATSTransport publishes messages to NATS JetStream with NATS client protocol. Every message is
+// published with reply subject and acknowledged by the stream which stored it, record hash is
+// Nats-Msg-Id header, so the stream drops duplicates of retried publishes within its duplicate window.
+// Subject without stream fails with no responders error. Connection is made on the first publish and
+// remade after errors. Safe for concurrent use.
+type NATSTransport struct {
+	NATSOpts
+
+	mu    sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	inbox string // prefix of reply subjects of the connection
+}
+
+// natsInfo is a part of server INFO we use
+type natsInfo struct {
+	TLSRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+	MaxPayload   int  `json:"max_payload"`
+	Headers      bool `json:"headers"`
+}
+
+// natsPubAck is JetStream reply to published message
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// natsConnect is CONNECT message of client
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Headers  bool   `json:"headers"`
+	NoResp   bool   `json:"no_responders"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+const (
+	natsAddress = "127.0.0.1:4222"
+	natsSubject = "orflog.records"
+	natsTimeout = 10 * time.Second
+)
+
+// NewNATSTransport makes transport with defaults for empty opts, connection is made by Publish
+func NewNATSTransport(opts NATSOpts) *NATSTransport {
+	if opts.Address == "" {
+		opts.Address = natsAddress
+	}
+	if opts.Subject == "" {
+		opts.Subject = natsSubject
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = natsTimeout
+	}
+	return &NATSTransport{NATSOpts: opts}
+}
+
+// Publish sends messages and waits for JetStream acknowledgement of every message
+func (n *NATSTransport) Publish(ctx context.Context, msgs []BusMessage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return fmt.Errorf("could not connect to nats: %v", err)
+		}
+	}
+	if err := n.publish(ctx, msgs); err != nil {
+		n.reset()
+		return err
+	}
+	return nil
+}
+
+// Close closes connection
+func (n *NATSTransport) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn, n.r, n.inbox = nil, nil, ""
+	return err
+}
+
+// subject returns subject of message, partition is derived from the key
+func (n *NATSTransport) subject(key string) string {
+	if n.Partitions <= 0 {
+		return n.Subject
+	}
+	return fmt.Sprintf("%s.%d", n.Subject, partition(key, n.Partitions))
+}
+
+// connect makes connection, must be called under lock
+func (n *NATSTransport) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: n.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.Address)
+	if err != nil {
+		return err
+	}
+	n.conn, n.r = conn, bufio.NewReader(conn)
+	if err = n.handshake(ctx); err != nil {
+		n.reset()
+		return err
+	}
+	return nil
+}
+
+// handshake reads INFO, upgrades to TLS if needed, sends CONNECT and subscribes to replies
+func (n *NATSTransport) handshake(ctx context.Context) error {
+	n.deadline(ctx)
+	line, err := n.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected server greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err = json.Unmarshal([]byte(strings.TrimSpace(line[len("INFO "):])), &info); err != nil {
+		return fmt.Errorf("invalid server info: %v", err)
+	}
+	if !info.Headers {
+		return errors.New("server doesn't support headers, JetStream requires nats-server 2.2 or newer")
+	}
+
+	if info.TLSRequired || n.TLSConfig != nil {
+		cfg := n.TLSConfig
+		if cfg == nil {
+			host, _, _ := net.SplitHostPort(n.Address)
+			cfg = &tls.Config{ServerName: host} //nolint:gosec
+		}
+		tlsConn := tls.Client(n.conn, cfg)
+		if err = tlsConn.Handshake(); err != nil {
+			return err
+		}
+		n.conn, n.r = tlsConn, bufio.NewReader(tlsConn)
+		n.deadline(ctx)
+	}
+
+	connect, err := json.Marshal(natsConnect{Name: "orflog", Lang: "go", Version: "3", Headers: true, NoResp: true,
+		User: n.User, Pass: n.Password, Token: n.Token})
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return err
+	}
+	n.inbox = fmt.Sprintf("_INBOX.orflog.%x", id)
+	if _, err = fmt.Fprintf(n.conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, n.inbox); err != nil {
+		return err
+	}
+	return n.waitReplies(nil)
+}
+
+// publish writes HPUB messages with reply subjects inbox.N, then waits for acks of all of them
+func (n *NATSTransport) publish(ctx context.Context, msgs []BusMessage) error {
+	n.deadline(ctx)
+	w := bufio.NewWriter(n.conn)
+	for i, msg := range msgs {
+		headers := "NATS/1.0\r\nNats-Msg-Id: " + msg.Key + "\r\n\r\n"
+		if _, err := fmt.Fprintf(w, "HPUB %s %s.%d %d %d\r\n%s", n.subject(msg.Key), n.inbox, i,
+			len(headers), len(headers)+len(msg.Value), headers); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg.Value); err != nil {
+			return err
+		}
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.waitReplies(msgs)
+}
+
+// waitReplies reads server messages until every message is acknowledged, or up to PONG if msgs is nil.
+// Answers server PING, fails on -ERR, negative ack or no responders status.
+func (n *NATSTransport) waitReplies(msgs []BusMessage) error {
+	acked := make([]bool, len(msgs))
+	left := len(msgs)
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case line == "PONG" && msgs == nil:
+			return nil
+		case line == "PING":
+			if _, err = n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats error: " + strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+		case len(fields) > 0 && (fields[0] == "MSG" || fields[0] == "HMSG"):
+			i, err := n.readReply(fields, msgs)
+			if err != nil {
+				return err
+			}
+			if i >= 0 && !acked[i] {
+				acked[i] = true
+				if left--; left == 0 {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// readReply reads payload of MSG or HMSG and returns index of acknowledged message, -1 for unknown reply
+func (n *NATSTransport) readReply(fields []string, msgs []BusMessage) (int, error) {
+	// MSG <subject> <sid> [reply] <size>, HMSG <subject> <sid> [reply] <header size> <size>
+	hdrSize, size := 0, 0
+	var err error
+	if size, err = strconv.Atoi(fields[len(fields)-1]); err != nil || size < 0 {
+		return -1, fmt.Errorf("invalid nats message %q", strings.Join(fields, " "))
+	}
+	if fields[0] == "HMSG" {
+		if hdrSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || hdrSize < 0 || hdrSize > size {
+			return -1, fmt.Errorf("invalid nats message %q", strings.Join(fields, " "))
+		}
+	}
+	payload := make([]byte, size+2)
+	if _, err = io.ReadFull(n.r, payload); err != nil {
+		return -1, err
+	}
+
+	i, err := strconv.Atoi(strings.TrimPrefix(fields[1], n.inbox+"."))
+	if err != nil || !strings.HasPrefix(fields[1], n.inbox+".") || i < 0 || i >= len(msgs) {
+		return -1, nil
+	}
+	if hdrSize > 0 {
+		status := strings.Fields(strings.SplitN(string(payload[:hdrSize]), "\r\n", 2)[0])
+		if len(status) > 1 && status[1] == "503" {
+			return -1, fmt.Errorf("no jetstream stream for subject %s", n.subject(msgs[i].Key))
+		}
+		if len(status) > 1 && status[1] != "200" {
+			return -1, fmt.Errorf("nats status %s", strings.Join(status[1:], " "))
+		}
+	}
+
+	var ack natsPubAck
+	if err = json.Unmarshal(payload[hdrSize:size], &ack); err != nil {
+		return -1, fmt.Errorf("invalid jetstream ack: %v", err)
+	}
+	if ack.Error != nil {
+		return -1, fmt.Errorf("jetstream error %d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return -1, errors.New("invalid jetstream ack: no stream")
+	}
+	return i, nil
+}
+
+// deadline limits the next operation by Timeout and ctx deadline
+func (n *NATSTransport) deadline(ctx context.Context) {
+	deadline := time.Now().Add(n.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = n.conn.SetDeadline(deadline)
+}
+
+// reset drops broken connection, must be called under lock
+func (n *NATSTransport) reset() {
+	if n.conn != nil {
+		_ = n.conn.Close()
+	}
+	n.conn, n.r, n.inbox = nil, nil, ""
+}
+
+// partition returns partition of the key in [0, partitions)
+func partition(key string, partitions int) int {
+	h := uint32(2166136261) // FNV-1a, stable across runs and implementations
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(partitions))
+}
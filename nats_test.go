@@ -0,0 +1,119 @@
+package orflog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNATSTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var mu sync.Mutex
+	var connects, subs, published []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"auth_required\":true,\"headers\":true,\"max_payload\":1048576}\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "CONNECT":
+						mu.Lock()
+						connects = append(connects, strings.TrimSpace(line[len("CONNECT "):]))
+						mu.Unlock()
+					case "SUB":
+						mu.Lock()
+						subs = append(subs, strings.TrimSpace(line))
+						mu.Unlock()
+					case "HPUB": // HPUB <subject> <reply> <header size> <size>
+						var hdrSize, size int
+						fmt.Sscanf(fields[3], "%d", &hdrSize)
+						fmt.Sscanf(fields[4], "%d", &size)
+						payload := make([]byte, size+2)
+						if _, err = io.ReadFull(r, payload); err != nil {
+							return
+						}
+						headers, value := string(payload[:hdrSize]), string(payload[hdrSize:size])
+						switch value {
+						case "reject":
+							fmt.Fprint(conn, "-ERR 'Permissions Violation'\r\n")
+							return
+						case "nostream":
+							status := "NATS/1.0 503\r\n\r\n"
+							fmt.Fprintf(conn, "HMSG %s 1 %d %d\r\n%s\r\n", fields[2], len(status), len(status), status)
+							continue
+						case "full":
+							ack := `{"error":{"code":503,"description":"maximum messages exceeded"}}`
+							fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+							continue
+						}
+						mu.Lock()
+						published = append(published, fields[1]+" "+value+" "+strings.TrimSpace(strings.Split(headers, "\r\n")[1]))
+						seq := len(published)
+						mu.Unlock()
+						ack := fmt.Sprintf(`{"stream":"ORF","seq":%d}`, seq)
+						fmt.Fprintf(conn, "PING\r\nMSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+					case "PING":
+						fmt.Fprint(conn, "PING\r\nPONG\r\n") // server ping is answered by client
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	n := NewNATSTransport(NATSOpts{Address: ln.Addr().String(), Subject: "orf", Partitions: 4, User: "user", Password: "secret"})
+	defer n.Close()
+	msgs := []BusMessage{{Key: "h1", Value: []byte("first")}, {Key: "h2", Value: []byte("second")}}
+	assert.NoError(t, n.Publish(context.Background(), msgs))
+
+	mu.Lock()
+	assert.Equal(t, []string{
+		fmt.Sprintf("orf.%d first Nats-Msg-Id: h1", partition("h1", 4)),
+		fmt.Sprintf("orf.%d second Nats-Msg-Id: h2", partition("h2", 4)),
+	}, published)
+	if assert.Equal(t, 1, len(connects)) {
+		assert.Contains(t, connects[0], `"headers":true,"no_responders":true,"user":"user","pass":"secret"`)
+	}
+	if assert.Equal(t, 1, len(subs)) {
+		assert.True(t, strings.HasPrefix(subs[0], "SUB _INBOX.orflog."), subs[0])
+	}
+	mu.Unlock()
+
+	err = n.Publish(context.Background(), []BusMessage{{Key: "h4", Value: []byte("nostream")}})
+	assert.EqualError(t, err, fmt.Sprintf("no jetstream stream for subject orf.%d", partition("h4", 4)))
+	err = n.Publish(context.Background(), []BusMessage{{Key: "h5", Value: []byte("full")}})
+	assert.EqualError(t, err, "jetstream error 503: maximum messages exceeded")
+
+	err = n.Publish(context.Background(), []BusMessage{{Key: "h3", Value: []byte("reject")}})
+	assert.EqualError(t, err, "nats error: Permissions Violation")
+	assert.NoError(t, n.Publish(context.Background(), msgs[:1]), "reconnected")
+	mu.Lock()
+	assert.Equal(t, 4, len(connects))
+	assert.Equal(t, 3, len(published))
+	mu.Unlock()
+
+	assert.Equal(t, partition("h1", 4), partition("h1", 4))
+	assert.Equal(t, "orflog.records", NewNATSTransport(NATSOpts{}).subject("h1"))
+}
@@ -0,0 +1,326 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenSearchOpts defines cluster, indices and batching of OpenSearch sink
+type OpenSearchOpts struct {
+	URL         string        `long:"url" env:"URL" default:"http://127.0.0.1:9200" description:"OpenSearch or Elasticsearch url"`
+	IndexPrefix string        `long:"index-prefix" env:"INDEX_PREFIX" default:"orflog-" description:"prefix of daily indices, prefix2006.01.02"`
+	User        string        `long:"user" env:"USER" description:"user of basic auth"`
+	Password    string        `long:"password" env:"PASSWORD" description:"password of basic auth"`
+	BatchSize   int           `long:"batch-size" env:"BATCH_SIZE" default:"500" description:"max documents in one bulk request"`
+	FlushAfter  time.Duration `long:"flush-after" env:"FLUSH_AFTER" default:"5s" description:"max time record waits for bulk request"`
+	Retries     int           `long:"retries" env:"RETRIES" default:"5" description:"retries of rejected with 429 or failed request"`
+	Backoff     time.Duration `long:"backoff" env:"BACKOFF" default:"1s" description:"delay before the first retry, doubled for every next one"`
+	MaxBackoff  time.Duration `long:"max-backoff" env:"MAX_BACKOFF" default:"1m" description:"max delay between retries"`
+	Timeout     time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"timeout of bulk request"`
+
+	Client *http.Client `no-flag:"true"` // http.Client with Timeout by default
+	Logger Logger       `no-flag:"true"` // global lgr logger by default
+}
+
+// OpenSearchSink indexes records as ECS documents with _bulk API. Record hash is document _id,
+// so repeated records overwrite themselves. Safe for concurrent use.
+type OpenSearchSink struct {
+	OpenSearchOpts
+}
+
+// bulkItem is a document of bulk request
+type bulkItem struct {
+	index string
+	id    string
+	doc   []byte
+}
+
+// bulkResponse is a part of _bulk response we use
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+const (
+	openSearchURL         = "http://127.0.0.1:9200"
+	openSearchIndexPrefix = "orflog-"
+	openSearchBatchSize   = 500
+	openSearchFlushAfter  = 5 * time.Second
+	openSearchTimeout     = 30 * time.Second
+	openSearchRetries     = 5
+	openSearchBackoff     = time.Second
+	openSearchMaxBackoff  = time.Minute
+)
+
+// NewOpenSearchSink makes sink with defaults for empty opts, Retries < 0 disables retries
+func NewOpenSearchSink(opts OpenSearchOpts) *OpenSearchSink {
+	if opts.URL == "" {
+		opts.URL = openSearchURL
+	}
+	if opts.IndexPrefix == "" {
+		opts.IndexPrefix = openSearchIndexPrefix
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = openSearchBatchSize
+	}
+	if opts.FlushAfter <= 0 {
+		opts.FlushAfter = openSearchFlushAfter
+	}
+	switch {
+	case opts.Retries == 0:
+		opts.Retries = openSearchRetries
+	case opts.Retries < 0:
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = openSearchBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = openSearchMaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = openSearchTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+	return &OpenSearchSink{OpenSearchOpts: opts}
+}
+
+// Run indexes records of the service matching filter until ctx is done or the service terminated,
+// failed batches are logged and don't stop the run
+func (o *OpenSearchSink) Run(ctx context.Context, svc *Service, filter Filter) {
+	ch, cancel := svc.SubscribeBatches(filter, BatchOpts{MaxSize: o.BatchSize, MaxLatency: o.FlushAfter})
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := o.Index(ctx, batch.Records...); err != nil {
+				o.Logger.Warn("could not index batch", "cycle", batch.Cycle, "source", batch.Source, "records", len(batch.Records), "error", err)
+			}
+		}
+	}
+}
+
+// Index sends records to daily indices in bulk requests of BatchSize documents. Documents rejected
+// with 429 are retried with backoff, other rejected documents are reported by error.
+func (o *OpenSearchSink) Index(ctx context.Context, orfs ...Orf) error {
+	items := make([]bulkItem, 0, len(orfs))
+	for _, orf := range orfs {
+		doc, err := json.Marshal(ECSDocument(orf))
+		if err != nil {
+			return err
+		}
+		items = append(items, bulkItem{index: o.IndexPrefix + orf.Time.UTC().Format("2006.01.02"), id: orf.HashString, doc: doc})
+	}
+
+	var errs []string
+	for len(items) > 0 {
+		n := o.BatchSize
+		if n > len(items) {
+			n = len(items)
+		}
+		if err := o.bulk(ctx, items[:n]); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, err.Error())
+		}
+		items = items[n:]
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// bulk sends items retrying the whole request on 429 and 5xx and documents rejected with 429
+func (o *OpenSearchSink) bulk(ctx context.Context, items []bulkItem) error {
+	var rejected []string
+	delay := o.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, failed, err := o.request(ctx, items)
+		rejected = append(rejected, failed...)
+		if _, ok := err.(errPermanent); ok {
+			return err
+		}
+		if err == nil && len(retry) == 0 {
+			break
+		}
+		if attempt >= o.Retries {
+			if err != nil {
+				return err
+			}
+			rejected = append(rejected, fmt.Sprintf("%d documents rejected with 429 after %d retries", len(retry), o.Retries))
+			break
+		}
+		if err == nil {
+			items = retry
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > o.MaxBackoff {
+			delay = o.MaxBackoff
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("documents rejected: %s", strings.Join(rejected, "; "))
+	}
+	return nil
+}
+
+// request makes one bulk request and returns items rejected with 429 to retry and errors
+// of documents rejected for other reasons
+func (o *OpenSearchSink) request(ctx context.Context, items []bulkItem) (retry []bulkItem, rejected []string, err error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		action, err := json.Marshal(map[string]map[string]string{"index": {"_index": item.index, "_id": item.id}})
+		if err != nil {
+			return nil, nil, errPermanent{err}
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(item.doc)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.URL, "/")+"/_bulk", &body)
+	if err != nil {
+		return nil, nil, errPermanent{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if o.User != "" {
+		req.SetBasicAuth(o.User, o.Password)
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, nil, fmt.Errorf("bulk request responded %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return nil, nil, errPermanent{fmt.Errorf("bulk request responded %s: %s", resp.Status, bytes.TrimSpace(data))}
+	}
+
+	var result bulkResponse
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, nil, errPermanent{fmt.Errorf("invalid bulk response: %v", err)}
+	}
+	if !result.Errors {
+		return nil, nil, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, nil, errPermanent{fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(items))}
+	}
+
+	for i, res := range result.Items {
+		for _, r := range res {
+			switch {
+			case r.Status == http.StatusTooManyRequests:
+				retry = append(retry, items[i])
+			case r.Status >= 300:
+				rejected = append(rejected, fmt.Sprintf("%s: %s", items[i].id, r.Error))
+			}
+		}
+	}
+	return retry, rejected, nil
+}
+
+// ECSDocument converts record to Elastic Common Schema document
+func ECSDocument(orf Orf) map[string]interface{} {
+	action := strings.ToLower(orf.RawAction)
+	if action == "" {
+		action = orf.Action
+	}
+	outcome := "success"
+	if orf.NonDelivery() {
+		outcome = "failure"
+	}
+
+	doc := map[string]interface{}{
+		"@timestamp": orf.Time.UTC().Format(time.RFC3339Nano),
+		"message":    orf.Message,
+		"event": map[string]interface{}{
+			"kind":     "event",
+			"category": []string{"email"},
+			"dataset":  "orf.log",
+			"action":   action,
+			"outcome":  outcome,
+			"reason":   orf.Reason.Detail,
+			"hash":     orf.HashString,
+		},
+		"email": map[string]interface{}{
+			"from": map[string]interface{}{"address": []string{ecsAddress(orf.SenderAddress, orf.Sender)}},
+			"to":   map[string]interface{}{"address": []string{ecsAddress(orf.RecipientAddress, orf.Recipients)}},
+		},
+		"observer": map[string]interface{}{"name": orf.Source, "product": "ORF", "type": "mail-filter"},
+		"orf": map[string]interface{}{
+			"action":              orf.Action,
+			"filtering_point":     orf.FilteringPoint,
+			"raw_action":          orf.RawAction,
+			"raw_filtering_point": orf.RawFilteringPoint,
+		},
+	}
+
+	source := map[string]interface{}{}
+	if orf.IP != nil {
+		source["ip"] = orf.IP.String()
+	} else if orf.RelatedIP != "" {
+		source["address"] = orf.RelatedIP
+	}
+	if orf.Geo.Country != "" {
+		source["geo"] = map[string]interface{}{"country_iso_code": orf.Geo.Country}
+	}
+	if orf.Geo.ASN != 0 {
+		source["as"] = map[string]interface{}{"number": orf.Geo.ASN, "organization": map[string]interface{}{"name": orf.Geo.ASOrg}}
+	}
+	if len(source) > 0 {
+		doc["source"] = source
+	}
+	if orf.Reason.Test != "" {
+		doc["rule"] = map[string]interface{}{"name": orf.Reason.Test, "ruleset": orf.Reason.ListName}
+	}
+	if len(orf.Labels) > 0 {
+		doc["labels"] = orf.Labels
+	}
+	return doc
+}
+
+// ecsAddress returns normalized address, raw one if address wasn't parsed
+func ecsAddress(addr Address, raw string) string {
+	if addr.Normalized != "" || addr.Null {
+		return addr.Normalized
+	}
+	return strings.TrimSpace(raw)
+}
@@ -0,0 +1,113 @@
+package orflog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSearchSink(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	indexed := map[string]map[string]interface{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		var items []string
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var action map[string]map[string]string
+			assert.NoError(t, json.Unmarshal(sc.Bytes(), &action))
+			if !sc.Scan() {
+				t.Fatal("no document")
+			}
+			var doc map[string]interface{}
+			assert.NoError(t, json.Unmarshal(sc.Bytes(), &doc))
+			id := action["index"]["_id"]
+			switch {
+			case id == "busy" && requests == 2:
+				items = append(items, `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}`)
+			case id == "bad":
+				items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+			default:
+				indexed[action["index"]["_index"]+"/"+id] = doc
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%s]}`, len(items) > 0 && requests == 2, strings.Join(items, ","))
+	}))
+	defer ts.Close()
+
+	sink := NewOpenSearchSink(OpenSearchOpts{URL: ts.URL, Backoff: time.Millisecond, BatchSize: 10})
+	orf := Orf{Time: time.Date(2019, 7, 6, 23, 0, 0, 0, time.UTC), Action: ifReject("Reject"), RawAction: "Reject",
+		RelatedIP: "95.108.1.1", Sender: "<Boss@Example.COM>", Recipients: "ann@example.com", Message: "DNSBL zen.spamhaus.org listed",
+		Source: "mx1", HashString: "h1"}
+	orf.IP = parseIP(orf.RelatedIP)
+	orf.Geo = Geo{Country: "RU", ASN: 13238, ASOrg: "YANDEX LLC"}
+	orf.Reason = ParseReason(orf.Message)
+	orf.SenderAddress, orf.RecipientAddress = ParseAddress(orf.Sender), ParseAddress(orf.Recipients)
+	busy := Orf{Time: orf.Time.Add(2 * time.Hour), HashString: "busy", Sender: "a@b.com"}
+	bad := Orf{Time: orf.Time, HashString: "bad"}
+
+	err := sink.Index(context.Background(), orf, busy, bad)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad: {\"type\":\"mapper_parsing_exception\"}")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, requests, "429 of request and of document are retried")
+	doc, ok := indexed["orflog-2019.07.06/h1"]
+	if !assert.True(t, ok) {
+		return
+	}
+	_, ok = indexed["orflog-2019.07.07/busy"]
+	assert.True(t, ok, "daily index by record time")
+
+	get := func(path string) interface{} {
+		var v interface{} = doc
+		for _, k := range strings.Split(path, ".") {
+			v = v.(map[string]interface{})[k]
+		}
+		return v
+	}
+	assert.Equal(t, "2019-07-06T23:00:00Z", doc["@timestamp"])
+	assert.Equal(t, "reject", get("event.action"))
+	assert.Equal(t, "failure", get("event.outcome"))
+	assert.Equal(t, []interface{}{"Boss@example.com"}, get("email.from.address"))
+	assert.Equal(t, []interface{}{"ann@example.com"}, get("email.to.address"))
+	assert.Equal(t, "95.108.1.1", get("source.ip"))
+	assert.Equal(t, "RU", get("source.geo.country_iso_code"))
+	assert.Equal(t, 13238.0, get("source.as.number"))
+	assert.Equal(t, "dnsbl", get("rule.name"))
+	assert.Equal(t, "zen.spamhaus.org", get("rule.ruleset"))
+	assert.Equal(t, "mx1", get("observer.name"))
+}
+
+func TestECSDocument(t *testing.T) {
+	doc := ECSDocument(Orf{Time: time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC), Action: "Доставлено", RelatedIP: "unknown",
+		Labels: map[string]string{"department": "sales"}})
+	assert.Equal(t, "Доставлено", doc["event"].(map[string]interface{})["action"])
+	assert.Equal(t, "success", doc["event"].(map[string]interface{})["outcome"])
+	assert.Equal(t, map[string]interface{}{"address": "unknown"}, doc["source"])
+	assert.Equal(t, map[string]string{"department": "sales"}, doc["labels"])
+	_, ok := doc["rule"]
+	assert.False(t, ok)
+}
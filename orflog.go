@@ -3,14 +3,9 @@ package orflog
 import (
 	"bytes"
 	"context"
-	"errors"
-	"io/ioutil"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
-
-	log "github.com/go-pkgz/lgr"
 )
 
 // Service create engine to collects logs from orf
@@ -19,39 +14,76 @@ type Service struct {
 
 	sync.WaitGroup
 
-	logMapAll struct {
-		sync.RWMutex
-		m map[string]interface{}
-	}
+	dedup    *dedupIndex
+	pipeline *pipeline
+	geo      *GeoIP // nil without geoip databases
+	rules    ruleSet
+	index    *Index
+	archive  *Archive
+	health   *health
+	read     readFiles
 
-	logMapOld struct {
-		sync.RWMutex
-		m map[string]interface{}
-	}
+	scanMu sync.Mutex   // serializes scans of Run and GetLastRecords
+	cfgMu  sync.RWMutex // guards settings changed by Reload, held by scans for reading
+	mu     sync.RWMutex
+	closer sync.Once
+
+	sources []Source
 
 	newLogCh    chan Orf
 	removeLogCh chan Orf
+	subs        subscribers
 
-	timeStart time.Time
+	window window // protected by mu
+	cycle  uint64 // number of the last scan, changed by scans only
 }
 
 // Opts collects parameters to initialize Service
 type Opts struct {
-	LogPaths  []string      `long:"log-paths" env:"LOG_PATHS" description:"path to log files" env-delim:","`
-	LogSuffix string        `long:"log-suffix" env:"LOG_SUFFIX" default:".log" description:"log file extension"`
-	OrfLine   string        `long:"orfline" env:"ORFLINE" default:"SMTPSVC" description:"search start word in log line"`
-	SleepTime time.Duration `long:"sleep-time" env:"SLEEP_TIME" default:"1m" description:"sleep time after every run"`
-	TimeRange struct {
+	LogPaths      []string      `long:"log-paths" env:"LOG_PATHS" description:"path to log files" env-delim:","`
+	Sources       []Source      `no-flag:"true"`
+	LogSuffix     string        `long:"log-suffix" env:"LOG_SUFFIX" default:".log" description:"log file extension"`
+	Encoding      string        `long:"encoding" env:"ENCODING" default:"auto" description:"log files encoding: auto, utf-8, utf-16le, utf-16be or windows-1251"`
+	TimeZone      string        `long:"time-zone" env:"TIME_ZONE" default:"Local" description:"time zone of log timestamps, IANA name or offset like +03:00"`
+	OrfLine       string        `long:"orfline" env:"ORFLINE" default:"SMTPSVC" description:"search start word in log line"`
+	SleepTime     time.Duration `long:"sleep-time" env:"SLEEP_TIME" default:"1m" description:"sleep time after every run"`
+	Retention     time.Duration `long:"retention" env:"RETENTION" description:"time records are remembered to skip duplicates, overrides time-range"`
+	Backfill      time.Duration `long:"backfill" env:"BACKFILL" description:"time range of records sent on start, retention by default"`
+	Workers       int           `long:"workers" env:"WORKERS" default:"4" description:"number of log files read concurrently"`
+	SourceTimeout time.Duration `long:"source-timeout" env:"SOURCE_TIMEOUT" default:"30s" description:"scan timeout for every log path"`
+	IndexDir      string        `long:"index-dir" env:"INDEX_DIR" description:"directory of full-text index of sent records, disabled if empty"`
+	ArchiveDir    string        `long:"archive-dir" env:"ARCHIVE_DIR" description:"directory of compressed archive of sent records, disabled if empty"`
+	NoChannel     bool          `long:"no-channel" env:"NO_CHANNEL" description:"close deprecated Channel() instead of sending records to it once called"`
+	TimeRange     struct {
 		Years  int `long:"years" env:"YEARS" default:"0" description:"years time range for logs"`
 		Months int `long:"months" env:"MONTHS" default:"1" description:"months time range for logs"`
 		Days   int `long:"days" env:"DAYS" default:"0" description:"days time range for logs"`
 	} `group:"time-range" namespace:"time-range" env-namespace:"TIME_RANGE"`
+	Dedup DedupOpts `group:"dedup" namespace:"dedup" env-namespace:"DEDUP"`
+	GeoIP GeoOpts   `group:"geoip" namespace:"geoip" env-namespace:"GEOIP"`
+
+	Rules  Rules   `no-flag:"true"` // records to process, applied while parsing
+	Stages []Stage `no-flag:"true"` // enrichment and filter stages run in order before records are sent or replayed
+	Logger Logger  `no-flag:"true"` // global lgr logger by default, per-cycle details are logged at debug level
+}
+
+// Source describes log path with its own settings, empty fields are taken from Opts
+type Source struct {
+	Path     string
+	Name     string // name of the source in records, Path by default
+	Encoding string
+	TimeZone string // time zone of ORF server writing the logs
+
+	location *time.Location
 }
 
 const (
 	logSuffix = ".log"
 	orfLine   = "SMTPSVC"
 	sleepTime = 10 * time.Second
+	workers   = 4
+
+	sourceTimeout = 30 * time.Second
 )
 
 // NewService initialize everything
@@ -60,139 +92,264 @@ func NewService(opts Opts) *Service {
 		Opts: opts,
 	}
 
-	if res.LogSuffix == "" {
-		res.LogSuffix = logSuffix
+	if res.Logger == nil {
+		res.Logger = defaultLogger
 	}
+	res.setDefaults()
+	res.sources = res.makeSources()
+	res.health = newHealth(res.sources)
 
-	if res.OrfLine == "" {
-		res.OrfLine = orfLine
+	res.newLogCh = make(chan Orf)
+	res.removeLogCh = make(chan Orf)
+	if res.NoChannel {
+		close(res.newLogCh)
+	} else {
+		res.subs.legacy = &subscriber{ch: res.newLogCh, done: make(chan struct{})} // attached by Channel()
 	}
+	res.dedup = newDedupIndex(res.Dedup)
 
-	if res.TimeRange.Years == 0 && res.TimeRange.Months == 0 && res.TimeRange.Days == 0 {
-		res.TimeRange.Months = 1
+	stages := make([]Stage, 0, len(res.Stages)+1)
+	if res.GeoIP.CountryDB != "" || res.GeoIP.ASNDB != "" {
+		geo, err := NewGeoIP(res.GeoIP)
+		if err != nil {
+			res.Logger.Warn("could not load geoip databases", "error", err)
+		} else {
+			res.geo = geo
+			stages = append(stages, geo.Stage())
+		}
 	}
+	res.pipeline = newPipeline(append(stages, res.Stages...), res.Logger)
+	res.rules = compileRules(res.Rules, res.Logger)
 
-	if res.SleepTime.Seconds() < 1 {
-		res.SleepTime = sleepTime
+	if res.IndexDir != "" {
+		index, err := openIndex(res.IndexDir, res.Logger)
+		if err != nil {
+			res.Logger.Warn("could not open index, search disabled", "dir", res.IndexDir, "error", err)
+		} else {
+			res.index = index
+		}
 	}
 
-	res.newLogCh = make(chan Orf)
-	res.removeLogCh = make(chan Orf)
-	res.logMapAll.m = make(map[string]interface{})
-	res.logMapOld.m = make(map[string]interface{})
-
-	res.timeStart = time.Now().AddDate(-res.TimeRange.Years, -res.TimeRange.Months, -res.TimeRange.Days)
+	if res.ArchiveDir != "" {
+		archive, err := openArchive(res.ArchiveDir, res.Logger)
+		if err != nil {
+			res.Logger.Warn("could not open archive, archiving disabled", "dir", res.ArchiveDir, "error", err)
+		} else {
+			res.archive = archive
+		}
+	}
 
 	return res
 }
 
-// Run service loop
-func (s *Service) Run(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			<-ctx.Done()
-			log.Printf("[WARN] init terminate service")
-			s.CloseChannels()
-			log.Printf("[WARN] service terminated")
-			return
-		default:
-			logFiles := s.getLastModifiedLogFiles()
-			log.Printf("logFiles: %d", len(logFiles))
+// setDefaults replaces empty and invalid scan settings with defaults
+func (s *Service) setDefaults() {
+	if s.LogSuffix == "" {
+		s.LogSuffix = logSuffix
+	}
+
+	if s.OrfLine == "" {
+		s.OrfLine = orfLine
+	}
 
-			allStrings := s.getAllStringsFromLogFiles(logFiles)
-			log.Printf("allStrings: %d", len(allStrings))
+	if s.TimeRange.Years == 0 && s.TimeRange.Months == 0 && s.TimeRange.Days == 0 {
+		s.TimeRange.Months = 1
+	}
 
-			s.logMapOld.m = make(map[string]interface{})
+	if s.SleepTime.Seconds() < 1 {
+		s.SleepTime = sleepTime
+	}
 
-			orfs := s.createOrfRecords(allStrings)
-			log.Printf("orfs: %d", len(orfs))
+	if s.Encoding == "" || !validEncoding(s.Encoding) {
+		if s.Encoding != "" {
+			s.Logger.Warn("unsupported encoding, default used", "encoding", s.Encoding, "default", EncodingAuto)
+		}
+		s.Encoding = EncodingAuto
+	}
 
-			s.removeOldRecords()
+	if _, err := loadLocation(s.TimeZone); err != nil {
+		s.Logger.Warn("unknown time zone, local used", "error", err)
+		s.TimeZone = "Local"
+	}
 
-			for _, orf := range orfs {
-				s.newLogCh <- *orf
-			}
+	if s.Workers < 1 {
+		s.Workers = workers
+	}
 
-			s.timeStart = time.Now().Add(-24 * time.Hour)
-			time.Sleep(s.SleepTime)
-		}
+	if s.SourceTimeout <= 0 {
+		s.SourceTimeout = sourceTimeout
 	}
 }
 
-// GetLastRecords from last program start
-func (s *Service) GetLastRecords() []*Orf {
-	logFiles := s.getLastModifiedLogFiles()
-	log.Printf("logFiles: %d", len(logFiles))
+// makeSources combines Sources and LogPaths filling empty source settings with Opts values
+func (s *Service) makeSources() []Source {
+	result := make([]Source, 0, len(s.Sources)+len(s.LogPaths))
+	result = append(result, s.Sources...)
+	for _, path := range s.LogPaths {
+		result = append(result, Source{Path: path})
+	}
 
-	allStrings := s.getAllStringsFromLogFiles(logFiles)
-	log.Printf("allStrings: %d", len(allStrings))
+	for i := range result {
+		if result[i].Name == "" {
+			result[i].Name = result[i].Path
+		}
+		if result[i].Encoding == "" {
+			result[i].Encoding = s.Encoding
+		}
+		if !validEncoding(result[i].Encoding) {
+			s.Logger.Warn("unsupported encoding, default used", "source", result[i].Name, "encoding", result[i].Encoding, "default", EncodingAuto)
+			result[i].Encoding = EncodingAuto
+		}
+		if result[i].TimeZone == "" {
+			result[i].TimeZone = s.TimeZone
+		}
+		loc, err := loadLocation(result[i].TimeZone)
+		if err != nil {
+			s.Logger.Warn("unknown time zone, default used", "source", result[i].Name, "error", err, "default", s.TimeZone)
+			loc, _ = loadLocation(s.TimeZone)
+		}
+		result[i].location = loc
+	}
 
-	s.logMapOld.m = make(map[string]interface{})
+	return result
+}
 
-	orfs := s.createOrfRecords(allStrings)
-	log.Printf("orfs: %d", len(orfs))
+// Run service loop
+func (s *Service) Run(ctx context.Context) {
+	defer func() {
+		s.Logger.Info("terminating service")
+		s.CloseChannels()
+		s.Logger.Info("service terminated")
+	}()
 
-	s.removeOldRecords()
+	for {
+		orfs, cycle := s.getNewRecords(ctx)
+		for _, orf := range orfs {
+			s.publish(ctx, cycle, *orf)
+		}
+		s.flushBatches(ctx, cycle)
+		if ctx.Err() != nil {
+			return
+		}
 
-	s.timeStart = time.Now().Add(-24 * time.Hour)
-	return orfs
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.sleepTime()):
+		}
+	}
 }
 
-// Channel return channels with new and old records
-func (s *Service) Channel() (new <-chan Orf) {
-	return s.newLogCh
+// sleepTime returns SleepTime, it can be changed by Reload
+func (s *Service) sleepTime() time.Duration {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.SleepTime
 }
 
-func (s *Service) CloseChannels() {
-	close(s.newLogCh)
-	close(s.removeLogCh)
+// GetLastRecords from last program start
+func (s *Service) GetLastRecords() []*Orf {
+	orfs, _ := s.getNewRecords(context.Background())
+	return orfs
 }
 
-func (s *Service) getLastModifiedLogFiles() []string {
-	result := make([]string, 0)
-	for _, dir := range s.LogPaths {
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			log.Printf("[WARN] could not open directory %s: %v", dir, err)
-			continue
-		}
+// getNewRecords scans log files and returns records not sent before with number of the scan cycle.
+// Records older than retention window are forgotten, on the first scan only records
+// inside backfill range are returned.
+func (s *Service) getNewRecords(ctx context.Context) ([]*Orf, uint64) {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	s.cycle++
+
+	now := time.Now()
+	s.health.scanStarted(now)
+	s.mu.RLock()
+	keepFrom, emitFrom := s.scanBounds(now)
+	started := s.window.started
+	s.mu.RUnlock()
 
-		for _, file := range files {
-			if !file.IsDir() && strings.HasSuffix(file.Name(), s.LogSuffix) && file.ModTime().After(s.timeStart) {
-				//if !file.IsDir() && strings.HasSuffix(file.Name(), s.LogSuffix) && file.ModTime().After(time.Now().Add(-24*time.Hour)) {
-				fileName := file.Name()
-				result = append(result, filepath.Join(dir, fileName))
+	result := make([]*Orf, 0)
+	// file modified before the window start can't have records in the window, and records of files
+	// not changed since the previous cycle are already known
+	s.read.begin()
+	scanned := s.scan(ctx, s.read.changed(modifiedAfter(earliest(keepFrom, emitFrom))), true)
+	s.read.finish()
+	refused := 0
+	for _, orf := range scanned {
+		if orf.Time.Before(keepFrom) {
+			// record older than retention is sent only by the first scan with longer backfill
+			if !started && !orf.Time.Before(emitFrom) && s.pipeline.run(ctx, orf) {
+				result = append(result, orf)
 			}
+			continue
+		}
+		if s.dedup.refuse(orf.Time) {
+			refused++
+			continue
 		}
+		if s.dedup.contains(orf.HashString, orf.Time) {
+			continue
+		}
+		if orf.Time.Before(emitFrom) {
+			s.dedup.add(orf.HashString, orf.Time) // skipped by the first scan, not sent later
+			continue
+		}
+		// only records kept by the pipeline are remembered, dropped ones are never sent or replayed
+		if !s.pipeline.run(ctx, orf) || !s.dedup.add(orf.HashString, orf.Time) {
+			continue
+		}
+		result = append(result, orf)
+	}
+	s.Logger.Debug("records found", "cycle", s.cycle, "scanned", len(scanned), "new", len(result))
+	if refused > 0 {
+		s.Logger.Warn("records of evicted dedup buckets are treated as sent, increase Dedup.MaxEntries",
+			"cycle", s.cycle, "refused", refused)
 	}
 
-	return result
-}
-
-func (s *Service) getAllStringsFromLogFiles(fileNames []string) []string {
-	result := make([]string, 0)
+	s.dedup.expire(keepFrom)
+	s.updateIndex(result, keepFrom)
+	s.archiveRecords(result)
 
-	for _, fileName := range fileNames {
-		b, err := ioutil.ReadFile(fileName)
-		if err != nil {
-			log.Printf("[WARN] could not read file %s: %v", fileName, err)
-			continue
-		}
+	s.mu.Lock()
+	s.window = window{from: keepFrom, to: now, started: true}
+	s.mu.Unlock()
 
-		lines := strings.Split(string(b), "\n")
+	end := time.Now()
+	s.health.scanFinished(s.cycle, end, len(result), earliest(keepFrom, emitFrom))
+	s.notifyCycle(CycleInfo{Cycle: s.cycle, Start: now, End: end, Scanned: len(scanned), Records: len(result)})
+	return result, s.cycle
+}
 
-		result = append(result, lines...)
-	}
+// DedupStats returns size and evictions of the index used to skip already sent records
+func (s *Service) DedupStats() DedupStats {
+	return s.dedup.stats()
+}
 
-	return result
+// CloseChannels closes Channel() and all subscriptions and releases geoip databases, safe to call
+// more than once. Records are not enriched with Geo after it.
+func (s *Service) CloseChannels() {
+	s.closer.Do(func() {
+		s.closeSubscribers()
+		close(s.removeLogCh)
+		if s.geo == nil {
+			return
+		}
+		if err := s.geo.Close(); err != nil {
+			s.Logger.Warn("could not close geoip databases", "error", err)
+		}
+	})
 }
 
-func (s *Service) createOrfRecords(lines []string) []*Orf {
+// createOrfRecords parses log lines of the source, every recipient of the line gets its own record
+func (s *Service) createOrfRecords(src Source, lines []string) []*Orf {
 	result := make([]*Orf, 0)
 	for _, line := range lines {
 		if strings.Contains(line, s.OrfLine) {
 			splitString := strings.Split(line, " ")
+			if len(splitString) < 12 {
+				s.Logger.Warn("could not parse line, too few fields", "source", src.Name, "line", line)
+				continue
+			}
 
 			messageFromSplit := splitString[12:]
 
@@ -203,11 +360,10 @@ func (s *Service) createOrfRecords(lines []string) []*Orf {
 				}
 			}
 
-			const timeFormat = "2006-01-02T15:04:05"
 			timeFromSplit := splitString[1]
-			t, err := time.Parse(timeFormat, timeFromSplit)
+			t, err := parseTime(timeFromSplit, src.location)
 			if err != nil {
-				log.Printf("[WARN] could not parse time %v: %v", timeFromSplit, err)
+				s.Logger.Warn("could not parse time", "source", src.Name, "time", timeFromSplit, "error", err)
 				continue
 			}
 
@@ -219,18 +375,25 @@ func (s *Service) createOrfRecords(lines []string) []*Orf {
 				Sender:         splitString[7],
 				Recipients:     splitString[8],
 				Message:        message.String(),
-			}
-
-			if strings.Contains(orf.Recipients, ";") {
-				splitRecipients := strings.Split(orf.Recipients, ";")
+				Source:         src.Name,
+				Reason:         ParseReason(message.String()),
+				SenderAddress:  ParseAddress(splitString[7]),
+				IP:             parseIP(splitString[6]),
 
-				for _, recipient := range splitRecipients {
-					orf.Recipients = recipient
-
-					s.appendRecord(orf, &result)
+				RawAction:         splitString[4],
+				RawFilteringPoint: splitString[5],
+			}
+			orf.Geo = ipRangeTags(orf.IP)
+
+			for _, recipient := range strings.Split(orf.Recipients, ";") {
+				rec := orf
+				rec.Recipients = recipient
+				rec.RecipientAddress = ParseAddress(recipient)
+				if !s.rules.match(&rec) {
+					continue
 				}
-			} else {
-				s.appendRecord(orf, &result)
+				rec.Hash()
+				result = append(result, &rec)
 			}
 		}
 	}
@@ -238,47 +401,6 @@ func (s *Service) createOrfRecords(lines []string) []*Orf {
 	return result
 }
 
-func (s *Service) appendRecord(orf Orf, result *[]*Orf) {
-	orf.Hash()
-	if err := s.addRecordToMaps(&orf); err != nil {
-		return
-	}
-	*result = append(*result, &orf)
-}
-
-func (s *Service) addRecordToMaps(orf *Orf) error {
-	if orf.Time.Before(s.timeStart) {
-		s.logMapOld.Lock()
-		s.logMapOld.m[orf.HashString] = nil
-		s.logMapOld.Unlock()
-		return errors.New("record time before needed time")
-	}
-
-	s.logMapAll.RLock()
-	_, ok := s.logMapAll.m[orf.HashString]
-	s.logMapAll.RUnlock()
-
-	if ok {
-		return errors.New("this record already in chan")
-	}
-
-	s.logMapAll.Lock()
-	s.logMapAll.m[orf.HashString] = nil
-	s.logMapAll.Unlock()
-
-	return nil
-}
-
-func (s *Service) removeOldRecords() {
-	for h := range s.logMapOld.m {
-		if _, ok := s.logMapAll.m[h]; ok {
-			s.logMapAll.Lock()
-			delete(s.logMapAll.m, h)
-			s.logMapAll.Unlock()
-		}
-	}
-}
-
 func ifReject(s string) string {
 	switch s {
 	case "Reject":
@@ -2,6 +2,7 @@ package orflog
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,11 +21,44 @@ func TestService_NewService(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 
+	newOrfs := svc.Channel()
 	go svc.Run(ctx)
 
-	newOrfs := svc.Channel()
 	for newOrf := range newOrfs {
 		assert.Equal(t, "sender@sender.com", newOrf.Sender)
 		t.Logf("Orf: %+v", newOrf)
 	}
 }
+
+func TestService_Concurrent(t *testing.T) {
+	svc := NewService(Opts{LogPaths: []string{"./test"}, SleepTime: time.Second, Backfill: 24 * 365 * 100 * time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	newOrfs := svc.Channel()
+	go svc.Run(ctx)
+
+	var wg sync.WaitGroup
+	results := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- len(svc.GetLastRecords())
+			svc.Window()
+		}()
+	}
+
+	received := 0
+	for range newOrfs {
+		received++
+	}
+	wg.Wait()
+	close(results)
+
+	for n := range results {
+		received += n
+	}
+	assert.Equal(t, 2, received, "every record is returned once")
+	svc.CloseChannels()
+}
@@ -0,0 +1,363 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPOpts defines OTLP/HTTP receiver and batching of exporter
+type OTLPOpts struct {
+	Endpoint    string            `long:"endpoint" env:"ENDPOINT" default:"http://127.0.0.1:4318" description:"OTLP/HTTP receiver, /v1/logs and /v1/traces are appended"`
+	Headers     map[string]string `long:"header" env:"HEADER" env-delim:"," description:"extra request headers, name:value"`
+	ServiceName string            `long:"service-name" env:"SERVICE_NAME" default:"orflog" description:"service.name resource attribute"`
+	BatchSize   int               `long:"batch-size" env:"BATCH_SIZE" default:"512" description:"max log records in one request"`
+	FlushAfter  time.Duration     `long:"flush-after" env:"FLUSH_AFTER" default:"5s" description:"max time record waits for request"`
+	Retries     int               `long:"retries" env:"RETRIES" default:"3" description:"retries of failed request"`
+	Timeout     time.Duration     `long:"timeout" env:"TIMEOUT" default:"10s" description:"timeout of one request"`
+	NoTraces    bool              `long:"no-traces" env:"NO_TRACES" description:"don't export spans of scan cycles"`
+
+	Client *http.Client `no-flag:"true"` // http.Client with Timeout by default
+	Logger Logger       `no-flag:"true"` // global lgr logger by default
+}
+
+// OTLPExporter sends records as OTLP log records and scan cycles as spans with OTLP/HTTP JSON encoding.
+// Log records are linked to the span of the scan cycle which found them.
+type OTLPExporter struct {
+	OTLPOpts
+
+	mu    sync.Mutex
+	spans map[uint64]otlpSpanContext // by cycle, recent cycles only
+}
+
+// otlpSpanContext identifies span of the scan cycle
+type otlpSpanContext struct {
+	traceID string
+	spanID  string
+}
+
+// otlp JSON messages, see opentelemetry-proto, 64 bit integers are strings
+type (
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano         string         `json:"timeUnixNano"`
+		ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+		SeverityNumber       int            `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 otlpAnyValue   `json:"body"`
+		Attributes           []otlpKeyValue `json:"attributes"`
+		TraceID              string         `json:"traceId,omitempty"`
+		SpanID               string         `json:"spanId,omitempty"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpLogsRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes"`
+		Status            struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTracesRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// OTLP severity numbers
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+const (
+	otlpEndpoint    = "http://127.0.0.1:4318"
+	otlpServiceName = "orflog"
+	otlpScopeName   = "github.com/zorion79/orflog"
+	otlpBatchSize   = 512
+	otlpFlushAfter  = 5 * time.Second
+	otlpRetries     = 3
+	otlpTimeout     = 10 * time.Second
+	otlpSpanKind    = 1 // SPAN_KIND_INTERNAL
+	otlpStatusOK    = 1
+	otlpKeepSpans   = 64 // cycles to remember span context for
+)
+
+// NewOTLPExporter makes exporter with defaults for empty opts, Retries < 0 disables retries
+func NewOTLPExporter(opts OTLPOpts) *OTLPExporter {
+	if opts.Endpoint == "" {
+		opts.Endpoint = otlpEndpoint
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = otlpServiceName
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = otlpBatchSize
+	}
+	if opts.FlushAfter <= 0 {
+		opts.FlushAfter = otlpFlushAfter
+	}
+	switch {
+	case opts.Retries == 0:
+		opts.Retries = otlpRetries
+	case opts.Retries < 0:
+		opts.Retries = 0
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = otlpTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+	return &OTLPExporter{OTLPOpts: opts, spans: make(map[uint64]otlpSpanContext)}
+}
+
+// Run exports records of the service matching filter and spans of its scan cycles until ctx is done or
+// the service terminated. Failed exports are logged and don't stop the run.
+func (e *OTLPExporter) Run(ctx context.Context, svc *Service, filter Filter) {
+	cycles := make(chan CycleInfo, otlpKeepSpans)
+	if !e.NoTraces {
+		remove := svc.ObserveCycles(func(info CycleInfo) {
+			e.spanContext(info.Cycle) // make ids before records of the cycle are sent
+			select {
+			case cycles <- info:
+			default:
+				e.Logger.Warn("span of scan cycle dropped, exporter is busy", "cycle", info.Cycle)
+			}
+		})
+		defer remove()
+	}
+	ch, cancel := svc.SubscribeBatches(filter, BatchOpts{MaxSize: e.BatchSize, MaxLatency: e.FlushAfter})
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case info := <-cycles:
+			if err := e.ExportCycle(ctx, info); err != nil {
+				e.Logger.Warn("could not export span of scan cycle", "cycle", info.Cycle, "error", err)
+			}
+		case batch, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := e.ExportBatch(ctx, batch); err != nil {
+				e.Logger.Warn("could not export batch", "cycle", batch.Cycle, "source", batch.Source, "records", len(batch.Records), "error", err)
+			}
+		}
+	}
+}
+
+// ExportBatch sends records of the batch as log records linked to span of the batch cycle
+func (e *OTLPExporter) ExportBatch(ctx context.Context, batch Batch) error {
+	var sc otlpSpanContext
+	if !e.NoTraces && batch.Cycle > 0 {
+		sc = e.spanContext(batch.Cycle)
+	}
+	records := make([]otlpLogRecord, 0, len(batch.Records))
+	for _, orf := range batch.Records {
+		rec := otlpLog(orf)
+		rec.TraceID, rec.SpanID = sc.traceID, sc.spanID
+		records = append(records, rec)
+	}
+
+	req := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource:  e.resource(),
+		ScopeLogs: []otlpScopeLogs{{Scope: otlpScope{Name: otlpScopeName}, LogRecords: records}},
+	}}}
+	return e.post(ctx, "/v1/logs", req)
+}
+
+// ExportCycle sends span of the scan cycle
+func (e *OTLPExporter) ExportCycle(ctx context.Context, info CycleInfo) error {
+	sc := e.spanContext(info.Cycle)
+	span := otlpSpan{
+		TraceID:           sc.traceID,
+		SpanID:            sc.spanID,
+		Name:              "orflog.scan",
+		Kind:              otlpSpanKind,
+		StartTimeUnixNano: otlpTime(info.Start),
+		EndTimeUnixNano:   otlpTime(info.End),
+		Attributes: []otlpKeyValue{
+			otlpInt("orflog.cycle", int64(info.Cycle)),
+			otlpInt("orflog.scanned", int64(info.Scanned)),
+			otlpInt("orflog.records", int64(info.Records)),
+		},
+	}
+	span.Status.Code = otlpStatusOK
+
+	req := otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   e.resource(),
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: otlpScopeName}, Spans: []otlpSpan{span}}},
+	}}}
+	return e.post(ctx, "/v1/traces", req)
+}
+
+// spanContext returns ids of the cycle span, making them for a new cycle
+func (e *OTLPExporter) spanContext(cycle uint64) otlpSpanContext {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sc, ok := e.spans[cycle]; ok {
+		return sc
+	}
+	sc := otlpSpanContext{traceID: randomHex(16), spanID: randomHex(8)}
+	e.spans[cycle] = sc
+	for c := range e.spans {
+		if c+otlpKeepSpans < cycle {
+			delete(e.spans, c)
+		}
+	}
+	return sc
+}
+
+func (e *OTLPExporter) resource() otlpResource {
+	return otlpResource{Attributes: []otlpKeyValue{otlpString("service.name", e.ServiceName)}}
+}
+
+// post sends request to endpoint path, retrying on network errors, 429 and 5xx
+func (e *OTLPExporter) post(ctx context.Context, path string, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err = e.request(ctx, path, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(errPermanent); ok || attempt >= e.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (e *OTLPExporter) request(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout:
+		return fmt.Errorf("otlp receiver responded %s", resp.Status)
+	default:
+		return errPermanent{fmt.Errorf("otlp receiver responded %s: %s", resp.Status, bytes.TrimSpace(data))}
+	}
+}
+
+// otlpLog converts record to log record, non-delivery is WARN, other actions are INFO
+func otlpLog(orf Orf) otlpLogRecord {
+	rec := otlpLogRecord{
+		TimeUnixNano:         otlpTime(orf.Time),
+		ObservedTimeUnixNano: otlpTime(time.Now()),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 otlpAnyValue{StringValue: &orf.Message},
+		Attributes: []otlpKeyValue{
+			otlpString("orf.action", orf.Action),
+			otlpString("orf.sender", orf.Sender),
+			otlpString("orf.recipients", orf.Recipients),
+			otlpString("orf.related_ip", orf.RelatedIP),
+			otlpString("orf.filtering_point", orf.FilteringPoint),
+			otlpString("orf.source", orf.Source),
+			otlpString("orf.hash", orf.HashString),
+		},
+	}
+	if orf.NonDelivery() {
+		rec.SeverityNumber, rec.SeverityText = otlpSeverityWarn, "WARN"
+	}
+	if orf.Reason.Test != "" {
+		rec.Attributes = append(rec.Attributes, otlpString("orf.reason.test", orf.Reason.Test))
+	}
+	return rec
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
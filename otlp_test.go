@@ -0,0 +1,105 @@
+package orflog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	logs := make(chan otlpLogsRequest, 10)
+	traces := make(chan otlpTracesRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("Api-Key"))
+		switch r.URL.Path {
+		case "/v1/logs":
+			var req otlpLogsRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			logs <- req
+		case "/v1/traces":
+			var req otlpTracesRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			traces <- req
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	exp := NewOTLPExporter(OTLPOpts{Endpoint: ts.URL, Headers: map[string]string{"Api-Key": "secret"}, FlushAfter: time.Hour})
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour, SleepTime: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exported := make(chan struct{})
+	go func() {
+		exp.Run(ctx, svc, nil)
+		close(exported)
+	}()
+	for {
+		svc.subs.RLock()
+		subscribed := len(svc.subs.batchers) > 0
+		svc.subs.RUnlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go svc.Run(ctx)
+
+	var span otlpSpan
+	select {
+	case req := <-traces:
+		if !assert.Equal(t, 1, len(req.ResourceSpans)) {
+			return
+		}
+		assert.Equal(t, "orflog", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		span = req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		assert.Equal(t, "orflog.scan", span.Name)
+		assert.Equal(t, 32, len(span.TraceID))
+		assert.Equal(t, 16, len(span.SpanID))
+		assert.Equal(t, otlpInt("orflog.records", 2), span.Attributes[2])
+	case <-time.After(time.Second):
+		t.Fatal("no traces")
+	}
+
+	select {
+	case req := <-logs:
+		records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+		if !assert.Equal(t, 2, len(records)) {
+			return
+		}
+		rec := records[0]
+		assert.Equal(t, span.TraceID, rec.TraceID, "linked to scan span")
+		assert.Equal(t, span.SpanID, rec.SpanID)
+		assert.Equal(t, otlpTime(time.Date(2019, 7, 6, 10, 10, 0, 0, time.Local)), rec.TimeUnixNano)
+		assert.Equal(t, otlpSeverityWarn, rec.SeverityNumber)
+		assert.Equal(t, "long message ", *rec.Body.StringValue)
+		attrs := map[string]string{}
+		for _, a := range rec.Attributes {
+			attrs[a.Key] = *a.Value.StringValue
+		}
+		assert.Equal(t, "sender@sender.com", attrs["orf.sender"])
+		assert.Equal(t, "first@recipient.com", attrs["orf.recipients"])
+		assert.Equal(t, "10.10.10.10", attrs["orf.related_ip"])
+		assert.Equal(t, filterPoint("BeforeArrival"), attrs["orf.filtering_point"])
+		assert.Equal(t, "./test", attrs["orf.source"])
+	case <-time.After(time.Second):
+		t.Fatal("no logs")
+	}
+	cancel()
+	<-exported
+
+	rec := otlpLog(Orf{Action: ifReject("WhitelistRecipient")})
+	assert.Equal(t, otlpSeverityInfo, rec.SeverityNumber)
+	assert.Error(t, NewOTLPExporter(OTLPOpts{Endpoint: ts.URL + "/missing"}).ExportCycle(context.Background(), CycleInfo{Cycle: 1}))
+}
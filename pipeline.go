@@ -0,0 +1,93 @@
+package orflog
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StageFunc enriches or filters record before it is sent, returns false to drop the record.
+// Error is counted and logged, record goes to the next stage anyway.
+type StageFunc func(ctx context.Context, orf *Orf) (keep bool, err error)
+
+// Stage is a named step of enrichment pipeline
+type Stage struct {
+	Name string
+	Func StageFunc
+}
+
+// StageStats accumulates results of the stage
+type StageStats struct {
+	Name    string
+	Calls   int64
+	Dropped int64
+	Errors  int64
+	Latency time.Duration // total time spent in the stage
+}
+
+// pipeline runs stages in order, safe for concurrent use
+type pipeline struct {
+	stages []Stage
+	logger Logger
+
+	mu    sync.Mutex
+	stats []StageStats
+}
+
+func newPipeline(stages []Stage, logger Logger) *pipeline {
+	res := &pipeline{stages: stages, logger: logger, stats: make([]StageStats, len(stages))}
+	for i, st := range stages {
+		res.stats[i].Name = st.Name
+	}
+	return res
+}
+
+// run passes record through all stages, returns false if the record was dropped
+func (p *pipeline) run(ctx context.Context, orf *Orf) bool {
+	for i, st := range p.stages {
+		start := time.Now()
+		keep, err := st.Func(ctx, orf)
+		elapsed := time.Since(start)
+
+		p.mu.Lock()
+		p.stats[i].Calls++
+		p.stats[i].Latency += elapsed
+		if err != nil {
+			p.stats[i].Errors++
+		}
+		if !keep {
+			p.stats[i].Dropped++
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			p.logger.Warn("stage failed", "stage", st.Name, "hash", orf.HashString, "error", err)
+		}
+		if !keep {
+			return false
+		}
+	}
+	return true
+}
+
+// statistics returns copy of stages stats
+func (p *pipeline) statistics() []StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]StageStats, len(p.stats))
+	copy(res, p.stats)
+	return res
+}
+
+// StageStats returns calls, drops, errors and latency of every enrichment stage
+func (s *Service) StageStats() []StageStats {
+	return s.pipeline.statistics()
+}
+
+// SetLabel sets label of the record, labels keep metadata added by enrichment stages
+func (o *Orf) SetLabel(key, value string) {
+	if o.Labels == nil {
+		o.Labels = make(map[string]string)
+	}
+	o.Labels[key] = value
+}
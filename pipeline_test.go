@@ -0,0 +1,95 @@
+package orflog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Stages(t *testing.T) {
+	svc := NewService(Opts{
+		LogPaths:  []string{"./test"},
+		Retention: 24 * 365 * 100 * time.Hour,
+		Stages: []Stage{
+			{Name: "department", Func: func(_ context.Context, orf *Orf) (bool, error) {
+				orf.SetLabel("department", "sales")
+				return true, nil
+			}},
+			{Name: "ad", Func: func(_ context.Context, orf *Orf) (bool, error) {
+				return true, errors.New("ad is not available")
+			}},
+			{Name: "drop-second", Func: func(_ context.Context, orf *Orf) (bool, error) {
+				return orf.Recipients != "second@recipient.com", nil
+			}},
+		},
+	})
+
+	orfs := svc.GetLastRecords()
+	if !assert.Equal(t, 1, len(orfs)) {
+		return
+	}
+	assert.Equal(t, "first@recipient.com", orfs[0].Recipients)
+	assert.Equal(t, map[string]string{"department": "sales"}, orfs[0].Labels)
+
+	stats := svc.StageStats()
+	if !assert.Equal(t, 3, len(stats)) {
+		return
+	}
+	assert.Equal(t, "department", stats[0].Name)
+	assert.Equal(t, int64(2), stats[0].Calls)
+	assert.Equal(t, int64(2), stats[1].Errors)
+	assert.Equal(t, int64(0), stats[1].Dropped)
+	assert.Equal(t, int64(1), stats[2].Dropped)
+	assert.Empty(t, svc.GetLastRecords(), "dropped record is not sent later")
+}
+
+func TestService_StagesReplay(t *testing.T) {
+	svc := NewService(Opts{
+		NoChannel: true,
+		LogPaths:  []string{"./test"},
+		Retention: 24 * 365 * 100 * time.Hour,
+		Stages: []Stage{
+			{Name: "department", Func: func(_ context.Context, orf *Orf) (bool, error) {
+				orf.SetLabel("department", "sales")
+				return true, nil
+			}},
+			{Name: "drop-second", Func: func(_ context.Context, orf *Orf) (bool, error) {
+				return orf.Recipients != "second@recipient.com", nil
+			}},
+		},
+	})
+	assert.Equal(t, 1, len(svc.GetLastRecords()))
+	assert.Equal(t, 1, svc.DedupStats().Entries, "dropped record is not remembered")
+
+	since := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{Since: since})
+	defer cancel()
+	svc.publish(context.Background(), 1, Orf{Recipients: "live@recipient.com", HashString: "live"})
+
+	var replayed []Orf
+	for i := 0; i < 2; i++ {
+		select {
+		case orf := <-ch:
+			replayed = append(replayed, orf)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if assert.Equal(t, 2, len(replayed)) {
+		assert.Equal(t, "first@recipient.com", replayed[0].Recipients)
+		assert.Equal(t, map[string]string{"department": "sales"}, replayed[0].Labels)
+		assert.Equal(t, "live@recipient.com", replayed[1].Recipients)
+	}
+
+	var recipients []string
+	err := svc.Replay(context.Background(), since, time.Now(), func(orf Orf) error {
+		assert.Equal(t, "sales", orf.Labels["department"])
+		recipients = append(recipients, orf.Recipients)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first@recipient.com"}, recipients)
+}
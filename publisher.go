@@ -0,0 +1,326 @@
+package orflog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BusMessage is a record encoded for message bus
+type BusMessage struct {
+	Key   string // record hash, used for partitioning
+	Value []byte
+	Time  time.Time // record time
+}
+
+// Transport delivers messages to message bus
+type Transport interface {
+	// Publish returns nil only after broker acknowledged all messages
+	Publish(ctx context.Context, msgs []BusMessage) error
+	Close() error
+}
+
+// PublisherOpts defines batching and checkpoint of publisher
+type PublisherOpts struct {
+	Checkpoint    string        `long:"checkpoint" env:"CHECKPOINT" description:"file with position of acknowledged records, in memory only if empty"`
+	Overlap       time.Duration `long:"overlap" env:"OVERLAP" default:"1h" description:"late records within this time before the last acknowledged one are still published"`
+	BatchSize     int           `long:"batch-size" env:"BATCH_SIZE" default:"100" description:"max records in one publish"`
+	FlushInterval time.Duration `long:"flush-interval" env:"FLUSH_INTERVAL" default:"1s" description:"max time record waits for batch"`
+	Retry         time.Duration `long:"retry" env:"RETRY" default:"1s" description:"delay before the first retry of failed publish, doubled up to a minute"`
+
+	Encode func(orf Orf) ([]byte, error) `no-flag:"true"` // json by default
+	Logger Logger                        `no-flag:"true"` // global lgr logger by default
+}
+
+// Checkpoint is position of acknowledged records: the latest record time and hashes of records
+// acknowledged within Overlap before it
+type Checkpoint struct {
+	Time   time.Time            `json:"time"`
+	Hashes map[string]time.Time `json:"hashes"`
+}
+
+// Publisher sends records of the service to message bus with at-least-once semantics: checkpoint
+// advances only after transport acknowledged the batch, and records of the checkpoint are skipped after
+// restart. Records older than checkpoint time minus Overlap are considered published.
+type Publisher struct {
+	PublisherOpts
+	transport Transport
+
+	mu         sync.Mutex
+	checkpoint Checkpoint
+}
+
+const (
+	publisherOverlap   = time.Hour
+	publisherBatchSize = 100
+	publisherFlush     = time.Second
+	publisherRetry     = time.Second
+	publisherMaxRetry  = time.Minute
+)
+
+// NewPublisher makes publisher with defaults for empty opts and loads checkpoint file if exists
+func NewPublisher(transport Transport, opts PublisherOpts) (*Publisher, error) {
+	if transport == nil {
+		return nil, errors.New("transport is not set")
+	}
+	if opts.Overlap <= 0 {
+		opts.Overlap = publisherOverlap
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = publisherBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = publisherFlush
+	}
+	if opts.Retry <= 0 {
+		opts.Retry = publisherRetry
+	}
+	if opts.Encode == nil {
+		opts.Encode = func(orf Orf) ([]byte, error) { return json.Marshal(orf) }
+	}
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+
+	res := &Publisher{PublisherOpts: opts, transport: transport, checkpoint: Checkpoint{Hashes: map[string]time.Time{}}}
+	if opts.Checkpoint != "" {
+		data, err := ioutil.ReadFile(opts.Checkpoint)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if err = json.Unmarshal(data, &res.checkpoint); err != nil {
+				return nil, errors.New("invalid checkpoint file: " + err.Error())
+			}
+			if res.checkpoint.Hashes == nil {
+				res.checkpoint.Hashes = map[string]time.Time{}
+			}
+		}
+	}
+	return res, nil
+}
+
+// Checkpoint returns position of acknowledged records
+func (p *Publisher) Checkpoint() Checkpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := Checkpoint{Time: p.checkpoint.Time, Hashes: make(map[string]time.Time, len(p.checkpoint.Hashes))}
+	for k, v := range p.checkpoint.Hashes {
+		res.Hashes[k] = v
+	}
+	return res
+}
+
+// Run publishes records of the service until ctx is done or the service terminated, failed publish is
+// retried until success, so the service is slowed down rather than records lost. Records sent since the
+// checkpoint are replayed if the service already runs. Transport is closed on exit.
+func (p *Publisher) Run(ctx context.Context, svc *Service) error {
+	defer func() {
+		if err := p.transport.Close(); err != nil {
+			p.Logger.Warn("could not close transport", "error", err)
+		}
+	}()
+
+	opts := SubscribeOpts{Buffer: p.BatchSize}
+	if cp := p.Checkpoint(); !cp.Time.IsZero() {
+		opts.Since = cp.Time.Add(-p.Overlap)
+	}
+	ch, cancel := svc.Subscribe(func(orf Orf) bool { return !p.published(orf) }, opts)
+	defer cancel()
+
+	batch := make([]Orf, 0, p.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := p.publish(ctx, batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case orf, ok := <-ch:
+			if !ok {
+				return flush()
+			}
+			if p.published(orf) {
+				continue
+			}
+			if batch = append(batch, orf); len(batch) < p.BatchSize {
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Publish sends records and advances checkpoint after acknowledgement, already published records are skipped
+func (p *Publisher) Publish(ctx context.Context, orfs ...Orf) error {
+	batch := make([]Orf, 0, len(orfs))
+	for _, orf := range orfs {
+		if !p.published(orf) {
+			batch = append(batch, orf)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return p.publish(ctx, batch)
+}
+
+// publish sends batch with retries until ack or ctx done, then saves checkpoint of records sent.
+// Records failed to encode are not sent and not added to checkpoint.
+func (p *Publisher) publish(ctx context.Context, batch []Orf) error {
+	msgs := make([]BusMessage, 0, len(batch))
+	encoded := make([]Orf, 0, len(batch))
+	for _, orf := range batch {
+		value, err := p.Encode(orf)
+		if err != nil {
+			p.Logger.Warn("could not encode record", "hash", orf.HashString, "error", err)
+			continue
+		}
+		msgs = append(msgs, BusMessage{Key: orf.HashString, Value: value, Time: orf.Time})
+		encoded = append(encoded, orf)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	delay := p.Retry
+	for {
+		err := p.transport.Publish(ctx, msgs)
+		if err == nil {
+			break
+		}
+		p.Logger.Warn("could not publish records", "records", len(msgs), "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > publisherMaxRetry {
+			delay = publisherMaxRetry
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, orf := range encoded {
+		p.checkpoint.Hashes[orf.HashString] = orf.Time
+		if orf.Time.After(p.checkpoint.Time) {
+			p.checkpoint.Time = orf.Time
+		}
+	}
+	from := p.checkpoint.Time.Add(-p.Overlap)
+	for hash, t := range p.checkpoint.Hashes {
+		if t.Before(from) {
+			delete(p.checkpoint.Hashes, hash)
+		}
+	}
+	if err := p.saveCheckpoint(); err != nil {
+		p.Logger.Warn("could not save checkpoint", "path", p.PublisherOpts.Checkpoint, "error", err)
+	}
+	return nil
+}
+
+// published checks if record is covered by checkpoint
+func (p *Publisher) published(orf Orf) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.checkpoint.Time.IsZero() {
+		return false
+	}
+	if orf.Time.Before(p.checkpoint.Time.Add(-p.Overlap)) {
+		return true
+	}
+	_, ok := p.checkpoint.Hashes[orf.HashString]
+	return ok
+}
+
+// saveCheckpoint writes checkpoint to temporary file and renames it, must be called under lock
+func (p *Publisher) saveCheckpoint() error {
+	if p.PublisherOpts.Checkpoint == "" {
+		return nil
+	}
+	data, err := json.Marshal(p.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.PublisherOpts.Checkpoint), filepath.Base(p.PublisherOpts.Checkpoint)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.PublisherOpts.Checkpoint)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// MemoryTransport keeps published messages in memory, for tests
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []BusMessage
+	closed   bool
+
+	// Fail is called before every publish, its error fails the publish
+	Fail func(msgs []BusMessage) error
+}
+
+// Publish appends messages
+func (m *MemoryTransport) Publish(_ context.Context, msgs []BusMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("transport is closed")
+	}
+	if m.Fail != nil {
+		if err := m.Fail(msgs); err != nil {
+			return err
+		}
+	}
+	m.messages = append(m.messages, msgs...)
+	return nil
+}
+
+// Messages returns published messages
+func (m *MemoryTransport) Messages() []BusMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]BusMessage(nil), m.messages...)
+}
+
+// Close marks transport closed
+func (m *MemoryTransport) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
@@ -0,0 +1,116 @@
+package orflog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisher(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	rec := func(hash string, d time.Duration) Orf { return Orf{HashString: hash, Time: start.Add(d)} }
+
+	failures := int32(1)
+	transport := &MemoryTransport{Fail: func(msgs []BusMessage) error {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return errors.New("broker is down")
+		}
+		return nil
+	}}
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+	p, err := NewPublisher(transport, PublisherOpts{Checkpoint: checkpoint, Overlap: time.Hour, Retry: time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, p.Publish(context.Background(), rec("a", 0), rec("b", 2*time.Hour)))
+	msgs := transport.Messages()
+	if assert.Equal(t, 2, len(msgs), "published after retry") {
+		assert.Equal(t, "a", msgs[0].Key)
+		var orf Orf
+		assert.NoError(t, json.Unmarshal(msgs[0].Value, &orf))
+		assert.Equal(t, rec("a", 0), orf)
+	}
+	cp := p.Checkpoint()
+	assert.Equal(t, start.Add(2*time.Hour), cp.Time)
+	assert.Equal(t, map[string]time.Time{"b": start.Add(2 * time.Hour)}, cp.Hashes, "hashes before overlap are dropped")
+
+	// restarted publisher skips acknowledged records and records before overlap
+	restarted, err := NewPublisher(&MemoryTransport{}, PublisherOpts{Checkpoint: checkpoint, Overlap: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, cp, restarted.Checkpoint())
+	assert.True(t, restarted.published(rec("a", 0)))
+	assert.True(t, restarted.published(rec("b", 2*time.Hour)))
+	assert.False(t, restarted.published(rec("late", 90*time.Minute)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewPublisher(nil, PublisherOpts{})
+	assert.Error(t, err)
+	stuck, _ := NewPublisher(&MemoryTransport{Fail: func([]BusMessage) error { return errors.New("down") }}, PublisherOpts{Retry: time.Millisecond})
+	assert.Equal(t, context.Canceled, stuck.Publish(ctx, rec("c", 0)))
+	assert.True(t, stuck.Checkpoint().Time.IsZero(), "not advanced without ack")
+
+	failEncode := func(orf Orf) ([]byte, error) {
+		if orf.HashString == "bad" {
+			return nil, errors.New("can't encode")
+		}
+		return []byte(orf.HashString), nil
+	}
+	encoding, _ := NewPublisher(&MemoryTransport{}, PublisherOpts{Overlap: 24 * time.Hour, Encode: failEncode, Logger: NopLogger})
+	assert.NoError(t, encoding.Publish(context.Background(), rec("good", 0), rec("bad", time.Hour)))
+	cp = encoding.Checkpoint()
+	assert.Equal(t, map[string]time.Time{"good": start}, cp.Hashes, "record failed to encode is not checkpointed")
+	assert.Equal(t, start, cp.Time)
+	assert.False(t, encoding.published(rec("bad", time.Hour)))
+}
+
+func TestPublisher_Run(t *testing.T) {
+	transport := &MemoryTransport{}
+	p, err := NewPublisher(transport, PublisherOpts{BatchSize: 2, FlushInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx, svc) }()
+	for {
+		svc.subs.RLock()
+		subscribed := svc.subs.legacy == nil && len(svc.subs.list) > 0
+		svc.subs.RUnlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, orf := range svc.GetLastRecords() {
+		svc.publish(ctx, 1, *orf)
+	}
+	svc.publish(ctx, 1, Orf{HashString: "single", Time: time.Now()})
+	deadline := time.After(time.Second)
+	for len(transport.Messages()) < 3 {
+		select {
+		case <-deadline:
+			t.Fatal("timeout")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Error(t, transport.Publish(context.Background(), nil), "closed on exit")
+}
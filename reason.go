@@ -0,0 +1,72 @@
+package orflog
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Reason describes ORF test which produced the record, parsed from Message
+type Reason struct {
+	Test     string // one of Test* constants, empty for unknown messages
+	Detail   string // test result or matched expression, whole message if test has no details
+	ListName string // DNSBL zone, SURBL list or other list name if present
+}
+
+// ORF tests recognized in messages
+const (
+	TestDNSBL            = "dnsbl"
+	TestSURBL            = "surbl"
+	TestSPF              = "spf"
+	TestKeyword          = "keyword"
+	TestAttachment       = "attachment"
+	TestGreylisting      = "greylisting"
+	TestDirectoryHarvest = "directory-harvest"
+	TestIPBlacklist      = "ip-blacklist"
+	TestSenderBlacklist  = "sender-blacklist"
+)
+
+// reasonPattern recognizes message of one test, named groups "list" and "detail" fill Reason
+type reasonPattern struct {
+	test string
+	re   *regexp.Regexp
+}
+
+// reasonPatterns is a catalog of ORF test messages, the first match wins,
+// so more specific patterns (SURBL mentions DNS lists too) go first
+var reasonPatterns = []reasonPattern{
+	{TestSURBL, regexp.MustCompile(`(?i)\b(?:SURBL|URIBL|URI blacklist)\b\W*(?:test\W*)?(?P<list>[a-z0-9-]+(?:\.[a-z0-9-]+)+)?[\s:)\]-]*(?P<detail>.*)`)},
+	{TestDNSBL, regexp.MustCompile(`(?i)\b(?:DNSBL|RBL|DNS blacklist)\b\W*(?:test\W*)?(?P<list>[a-z0-9-]+(?:\.[a-z0-9-]+)+)?[\s:)\]-]*(?P<detail>.*)`)},
+	{TestSPF, regexp.MustCompile(`(?i)\bSPF\b.*?\b(?P<detail>softfail|fail|neutral|none|permerror|temperror)\b`)},
+	{TestKeyword, regexp.MustCompile(`(?i)\bkeyword (?:filter(?:ing)?|expression|blacklist)\b[\s:)\]-]*(?P<detail>.*)`)},
+	{TestAttachment, regexp.MustCompile(`(?i)\battachment (?:filter(?:ing)?|blacklist|blocked|replaced)\b[\s:)\]-]*(?P<detail>.*)`)},
+	{TestGreylisting, regexp.MustCompile(`(?i)\b(?:grey|gray) ?listing\b[\s:)\]-]*(?P<detail>.*)`)},
+	{TestDirectoryHarvest, regexp.MustCompile(`(?i)\b(?:directory harvest(?: attack)?(?: protection)?|DHA)\b[\s:)\]-]*(?P<detail>.*)`)},
+	{TestIPBlacklist, regexp.MustCompile(`(?i)\bIP blacklist\b\W*(?P<list>[^:()]*?)\W*$`)},
+	{TestSenderBlacklist, regexp.MustCompile(`(?i)\b(?:sender blacklist|blacklisted sender)\b[\s:)\]-]*(?P<detail>.*)`)},
+}
+
+// ParseReason extracts ORF test details from free text message,
+// unknown messages give Reason with empty Test and the message as Detail
+func ParseReason(message string) Reason {
+	message = strings.TrimSpace(message)
+	for _, p := range reasonPatterns {
+		m := p.re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		res := Reason{Test: p.test}
+		for i, name := range p.re.SubexpNames() {
+			switch name {
+			case "list":
+				res.ListName = strings.ToLower(strings.TrimSpace(m[i]))
+			case "detail":
+				res.Detail = strings.TrimSpace(m[i])
+			}
+		}
+		if res.Detail == "" {
+			res.Detail = message
+		}
+		return res
+	}
+	return Reason{Detail: message}
+}
@@ -0,0 +1,31 @@
+package orflog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReason(t *testing.T) {
+	tbl := []struct {
+		message string
+		reason  Reason
+	}{
+		{"DNSBL Test (zen.spamhaus.org) ", Reason{Test: TestDNSBL, ListName: "zen.spamhaus.org", Detail: "DNSBL Test (zen.spamhaus.org)"}},
+		{"Blacklisted by DNSBL bl.spamcop.net: 127.0.0.2", Reason{Test: TestDNSBL, ListName: "bl.spamcop.net", Detail: "127.0.0.2"}},
+		{"SURBL Test (multi.surbl.org) example.com", Reason{Test: TestSURBL, ListName: "multi.surbl.org", Detail: "example.com"}},
+		{"SPF Test result: softfail ", Reason{Test: TestSPF, Detail: "softfail"}},
+		{"Keyword Filtering: (viagra|cialis)", Reason{Test: TestKeyword, Detail: "(viagra|cialis)"}},
+		{"Attachment Filtering: invoice.exe", Reason{Test: TestAttachment, Detail: "invoice.exe"}},
+		{"Greylisting ", Reason{Test: TestGreylisting, Detail: "Greylisting"}},
+		{"Directory Harvest Attack Protection: unknown@recipient.com", Reason{Test: TestDirectoryHarvest, Detail: "unknown@recipient.com"}},
+		{"IP Blacklist (Local blacklist)", Reason{Test: TestIPBlacklist, ListName: "local blacklist", Detail: "IP Blacklist (Local blacklist)"}},
+		{"Sender Blacklist: spam@sender.com", Reason{Test: TestSenderBlacklist, Detail: "spam@sender.com"}},
+		{"long message ", Reason{Detail: "long message"}},
+		{"", Reason{}},
+	}
+
+	for _, tt := range tbl {
+		assert.Equal(t, tt.reason, ParseReason(tt.message), tt.message)
+	}
+}
@@ -4,11 +4,38 @@ import (
 	"crypto/md5" //nolint:gosec
 	"encoding/json"
 	"fmt"
+	"net"
 	"time"
 )
 
-//Orf collects fields from orf log file
+// Orf collects fields from orf log file
 type Orf struct {
+	Time           time.Time // always in UTC
+	Action         string
+	FilteringPoint string
+	RelatedIP      string
+	Sender         string
+	Recipients     string
+	Message        string
+	HashString     string
+	Source         string // name of the log path record read from
+	Reason         Reason // test details parsed from Message
+
+	RawAction         string // action as logged by ORF, Action is its description
+	RawFilteringPoint string // filtering point as logged by ORF
+
+	SenderAddress    Address // normalized Sender
+	RecipientAddress Address // normalized Recipients
+
+	IP  net.IP // parsed RelatedIP, nil if empty or invalid
+	Geo Geo    // country and ASN of IP
+
+	Labels map[string]string // metadata added by enrichment stages
+}
+
+// hashFields lists Orf fields identifying the record, the same line read from
+// different sources gives the same hash
+type hashFields struct {
 	Time           time.Time
 	Action         string
 	FilteringPoint string
@@ -21,6 +48,14 @@ type Orf struct {
 
 // Hash return hash of Orf
 func (o *Orf) Hash() {
-	jsonBytes, _ := json.Marshal(o)
+	jsonBytes, _ := json.Marshal(hashFields{
+		Time:           o.Time,
+		Action:         o.Action,
+		FilteringPoint: o.FilteringPoint,
+		RelatedIP:      o.RelatedIP,
+		Sender:         o.Sender,
+		Recipients:     o.Recipients,
+		Message:        o.Message,
+	})
 	o.HashString = fmt.Sprintf("%x", md5.Sum(jsonBytes)) //nolint:gosec
 }
@@ -0,0 +1,84 @@
+package orflog
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var fileNameDateRe = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+
+// Replay sends records with time in [from, to] to handler in time order. Only files modified after from
+// and, if file name has a date (orf_20190706.log, 2019-07-06.log), dated not after to are read.
+// Records read from log files pass the enrichment and filter stages as in Run, archived records
+// have passed them before archiving. With ArchiveDir set archived records are replayed too, so history
+// outlives the log files. Replay doesn't change state of Run: records are deduplicated within the replay
+// only and sent records are not remembered. Replay stops on the first handler error and returns it.
+func (s *Service) Replay(ctx context.Context, from, to time.Time, handler func(orf Orf) error) error {
+	scanned := s.scan(ctx, replayFiles(from, to), false)
+	orfs := make([]*Orf, 0, len(scanned))
+	for _, orf := range scanned {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if orf.Time.Before(from) || orf.Time.After(to) || !s.pipeline.run(ctx, orf) {
+			continue
+		}
+		orfs = append(orfs, orf)
+	}
+	if s.archive != nil {
+		archived, err := s.archive.read(ctx, from, to)
+		if err != nil {
+			return err
+		}
+		for i := range archived {
+			orfs = append(orfs, &archived[i])
+		}
+		sort.SliceStable(orfs, func(i, j int) bool { return orfs[i].Time.Before(orfs[j].Time) })
+	}
+
+	seen := make(map[string]bool)
+	for _, orf := range orfs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if orf.Time.Before(from) || orf.Time.After(to) || seen[orf.HashString] {
+			continue
+		}
+		seen[orf.HashString] = true
+		if err := handler(*orf); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// replayFiles selects files which may have records in [from, to]. Date in file name is the date of
+// the first record, rotation period is unknown, so only files started after to are skipped by name.
+func replayFiles(from, to time.Time) fileSelector {
+	return func(src Source, file os.FileInfo) bool {
+		if file.ModTime().Before(from) {
+			return false
+		}
+		if date, ok := fileNameDate(file.Name(), src.location); ok && date.After(to) {
+			return false
+		}
+		return true
+	}
+}
+
+// fileNameDate returns date from the file name in loc
+func fileNameDate(name string, loc *time.Location) (time.Time, bool) {
+	if loc == nil {
+		loc = time.Local
+	}
+	for _, m := range fileNameDateRe.FindAllStringSubmatch(name, -1) {
+		t, err := time.ParseInLocation("20060102", m[1]+m[2]+m[3], loc)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,64 @@
+package orflog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Replay(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	day := func(d, h int) time.Time { return time.Date(2026, 3, d, h, 0, 0, 0, time.UTC) }
+	writeLog(t, dir, "orf_20260301.log", strings.Join([]string{
+		orfLogLine(day(1, 10), "first@sender.com"),
+		orfLogLine(day(2, 12), "third@sender.com"),
+		orfLogLine(day(5, 23), "late@sender.com"),
+	}, "\n"))
+	writeLog(t, dir, "orf_20260302.log", orfLogLine(day(2, 11), "second@sender.com"))
+	writeLog(t, dir, "orf_20260306.log", orfLogLine(day(4, 10), "skipped-by-name@sender.com"))
+	writeLog(t, dir, "old.log", orfLogLine(day(3, 10), "skipped-by-mtime@sender.com"))
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "old.log"), day(1, 0), day(1, 0)))
+
+	svc := NewService(Opts{LogPaths: []string{dir}, TimeZone: "UTC"})
+
+	var senders []string
+	err := svc.Replay(context.Background(), day(1, 10), day(5, 0), func(orf Orf) error {
+		senders = append(senders, orf.Sender)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first@sender.com", "second@sender.com", "third@sender.com"}, senders)
+	assert.Equal(t, 0, svc.DedupStats().Entries, "live dedup is not changed")
+
+	errStop := errors.New("stop")
+	count := 0
+	err = svc.Replay(context.Background(), day(1, 0), day(5, 0), func(orf Orf) error {
+		count++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestFileNameDate(t *testing.T) {
+	tm, ok := fileNameDate("orf_20190706.log", time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2019, 7, 6, 0, 0, 0, 0, time.UTC), tm)
+
+	tm, ok = fileNameDate("orf-2019-07-06.log", time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2019, 7, 6, 0, 0, 0, 0, time.UTC), tm)
+
+	_, ok = fileNameDate("orf.log", time.UTC)
+	assert.False(t, ok)
+	_, ok = fileNameDate("orf_20191399.log", time.UTC)
+	assert.False(t, ok)
+}
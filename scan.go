@@ -0,0 +1,267 @@
+package orflog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFile describes one file found in the log path
+type logFile struct {
+	ctx     context.Context // deadline of the log path the file belongs to
+	src     Source
+	source  int // index of the log path
+	index   int // index of the file in the log path
+	path    string
+	modTime time.Time
+	size    int64
+	report  bool // update health with the file
+	done    func()
+}
+
+// fileSelector decides if log file of the source should be read
+type fileSelector func(src Source, file os.FileInfo) bool
+
+// modifiedAfter selects files modified after t
+func modifiedAfter(t time.Time) fileSelector {
+	return func(_ Source, file os.FileInfo) bool { return file.ModTime().After(t) }
+}
+
+// fileStamp identifies content of log file by listing
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// readFiles remembers files read by scan cycles, so the next cycle reads only new and changed files.
+// Modification time and size are compared with the previous listing, not with local clock, as
+// file server clock may differ. Files failed to read are not remembered and read again.
+type readFiles struct {
+	mu    sync.Mutex
+	prev  map[string]fileStamp // files read or unchanged in the previous cycle
+	next  map[string]fileStamp // files of the current cycle
+	stale bool                 // reset during the cycle, next is not used
+}
+
+// begin starts cycle, must be followed by finish
+func (r *readFiles) begin() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next, r.stale = make(map[string]fileStamp), false
+}
+
+// finish keeps files of the cycle for the next one
+func (r *readFiles) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prev, r.next = r.next, nil
+	if r.stale {
+		r.prev = nil
+	}
+}
+
+// reset forgets read files, the next cycle reads all files in the window
+func (r *readFiles) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prev, r.stale = nil, true
+}
+
+// changed wraps selector to skip files not changed since the previous cycle
+func (r *readFiles) changed(selector fileSelector) fileSelector {
+	return func(src Source, file os.FileInfo) bool {
+		if !selector(src, file) {
+			return false
+		}
+		path := filepath.Join(src.Path, file.Name())
+		stamp := fileStamp{modTime: file.ModTime(), size: file.Size()}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if prev, ok := r.prev[path]; ok && prev.modTime.Equal(stamp.modTime) && prev.size == stamp.size {
+			r.next[path] = stamp
+			return false
+		}
+		return true
+	}
+}
+
+// done remembers file read by the cycle
+func (r *readFiles) done(path string, stamp fileStamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next != nil {
+		r.next[path] = stamp
+	}
+}
+
+// fileRecords collects records parsed from one log file
+type fileRecords struct {
+	source  int
+	index   int
+	lines   int
+	records []*Orf
+}
+
+// scan reads all log files chosen by selector and returns parsed records in time order.
+// Log paths are listed concurrently, files are read by the pool of Workers, every log path
+// gets SourceTimeout to complete so one hung share doesn't stall the others. Only scans with report
+// set, the scan cycles, update reachability and files of Status; replays don't.
+func (s *Service) scan(ctx context.Context, selector fileSelector, report bool) []*Orf {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+
+	jobs := make(chan logFile)
+	results := make(chan fileRecords)
+
+	var listWg sync.WaitGroup
+	for i, src := range s.sources {
+		listWg.Add(1)
+		go func(i int, src Source) {
+			defer listWg.Done()
+
+			srcCtx, cancel := context.WithTimeout(ctx, s.SourceTimeout)
+			defer cancel()
+
+			files, err := s.listLogFiles(srcCtx, src, selector)
+			if err != nil {
+				s.Logger.Warn("could not open directory", "source", src.Name, "path", src.Path, "error", err)
+				if report {
+					s.health.sourceFailed(i, time.Now(), err)
+				}
+				return
+			}
+			if report {
+				s.health.sourceListed(i, time.Now())
+			}
+
+			var filesWg sync.WaitGroup
+			for j, file := range files {
+				filesWg.Add(1)
+				jobs <- logFile{ctx: srcCtx, src: src, source: i, index: j, path: filepath.Join(src.Path, file.Name()),
+					modTime: file.ModTime(), size: file.Size(), report: report, done: filesWg.Done}
+			}
+			filesWg.Wait() // keep source context alive until all its files are read
+		}(i, src)
+	}
+
+	var workersWg sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for file := range jobs {
+				results <- s.readLogFile(file)
+				file.done()
+			}
+		}()
+	}
+
+	go func() {
+		listWg.Wait()
+		close(jobs)
+		workersWg.Wait()
+		close(results)
+	}()
+
+	files := make([]fileRecords, 0)
+	for res := range results {
+		files = append(files, res)
+	}
+
+	// merge files in the order of log paths first, stable sort by time keeps it for equal times
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].source != files[j].source {
+			return files[i].source < files[j].source
+		}
+		return files[i].index < files[j].index
+	})
+
+	lines, result := 0, make([]*Orf, 0)
+	for _, file := range files {
+		lines += file.lines
+		result = append(result, file.records...)
+	}
+	s.Logger.Debug("log files scanned", "files", len(files), "lines", lines, "records", len(result))
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+
+	return result
+}
+
+// listLogFiles returns log files of the source chosen by selector
+func (s *Service) listLogFiles(ctx context.Context, src Source, selector fileSelector) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	err := withContext(ctx, func() (err error) {
+		files, err = ioutil.ReadDir(src.Path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]os.FileInfo, 0)
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), s.LogSuffix) && selector(src, file) {
+			result = append(result, file)
+		}
+	}
+
+	return result, nil
+}
+
+// readLogFile reads and parses one log file, unreadable file gives no records
+func (s *Service) readLogFile(file logFile) fileRecords {
+	res := fileRecords{source: file.source, index: file.index}
+
+	var b []byte
+	err := withContext(file.ctx, func() (err error) {
+		b, err = ioutil.ReadFile(file.path)
+		return err
+	})
+	if err != nil {
+		s.Logger.Warn("could not read file", "path", file.path, "error", err)
+		if file.report {
+			s.health.sourceFailed(file.source, time.Now(), fmt.Errorf("could not read %s: %v", file.path, err))
+		}
+		return res
+	}
+
+	text, err := decode(b, file.src.Encoding)
+	if err != nil {
+		s.Logger.Warn("could not decode file", "path", file.path, "encoding", file.src.Encoding, "error", err)
+		return res
+	}
+	if file.report {
+		s.read.done(file.path, fileStamp{modTime: file.modTime, size: file.size})
+	}
+
+	lines := splitLines(text)
+	res.lines = len(lines)
+	res.records = s.createOrfRecords(file.src, lines)
+	if file.report {
+		s.health.fileRead(file.source, FileStatus{Source: file.src.Name, Path: file.path, Size: int64(len(b)),
+			Lines: res.lines, Records: len(res.records), ModTime: file.modTime, ReadAt: time.Now()})
+	}
+	return res
+}
+
+// withContext runs blocking fn and gives up waiting for it when ctx is done.
+// Reads from network shares can't be interrupted, so fn is left to finish in background
+// and its results must not be used after withContext returned ctx error.
+func withContext(ctx context.Context, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn() }()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		return err
+	}
+}
@@ -0,0 +1,92 @@
+package orflog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_scan(t *testing.T) {
+	dir1, dir2 := tempLogDir(t), tempLogDir(t)
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+
+	writeLog(t, dir1, "a.log", "SMTPSVC 2019-07-06T10:10:03 2 3 Reject BeforeArrival 10.10.10.10 third@sender.com r@r.com 9 10 11 msg")
+	writeLog(t, dir1, "b.log", "SMTPSVC 2019-07-06T10:10:01 2 3 Reject BeforeArrival 10.10.10.10 first@sender.com r@r.com 9 10 11 msg")
+	writeLog(t, dir2, "c.log", "SMTPSVC 2019-07-06T10:10:02 2 3 Reject BeforeArrival 10.10.10.10 second@sender.com r@r.com 9 10 11 msg")
+	writeLog(t, dir2, "d.txt", "SMTPSVC 2019-07-06T10:10:00 2 3 Reject BeforeArrival 10.10.10.10 skipped@sender.com r@r.com 9 10 11 msg")
+
+	svc := NewService(Opts{LogPaths: []string{dir1, dir2, "./nonexistent"}, Workers: 2})
+
+	orfs := svc.scan(context.Background(), modifiedAfter(time.Time{}), true)
+	if !assert.Equal(t, 3, len(orfs)) {
+		return
+	}
+	assert.Equal(t, "first@sender.com", orfs[0].Sender)
+	assert.Equal(t, "second@sender.com", orfs[1].Sender)
+	assert.Equal(t, "third@sender.com", orfs[2].Sender)
+}
+
+func TestService_scanChangedFiles(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	line := "SMTPSVC 2019-07-06T10:10:0%d 2 3 Reject BeforeArrival 10.10.10.10 %s@sender.com r@r.com 9 10 11 msg"
+	writeLog(t, dir, "a.log", fmt.Sprintf(line, 1, "first"))
+	writeLog(t, dir, "b.log", fmt.Sprintf(line, 2, "second"))
+
+	opts := Opts{NoChannel: true, LogPaths: []string{dir}, Retention: 24 * 365 * 100 * time.Hour, Logger: NopLogger}
+	svc := NewService(opts)
+	filesRead := func() int { return svc.Status().Sources[0].Files }
+
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+	assert.Equal(t, 2, filesRead())
+	assert.Empty(t, svc.GetLastRecords())
+	assert.Equal(t, 0, filesRead(), "unchanged files are not read")
+
+	writeLog(t, dir, "b.log", fmt.Sprintf(line, 2, "second")+"\n"+fmt.Sprintf(line, 3, "third"))
+	if orfs := svc.GetLastRecords(); assert.Equal(t, 1, len(orfs)) {
+		assert.Equal(t, "third@sender.com", orfs[0].Sender)
+	}
+	assert.Equal(t, 1, filesRead(), "only changed file is read")
+
+	svc.Reload(opts)
+	assert.Empty(t, svc.GetLastRecords())
+	assert.Equal(t, 2, filesRead(), "all files are read after reload")
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	err := withContext(ctx, func() error {
+		<-release // emulate hung network share
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	err = withContext(context.Background(), func() error { return os.ErrNotExist })
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func tempLogDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "orflog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeLog(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,288 @@
+package orflog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status describes what the service did lately
+type Status struct {
+	Started          time.Time // time the service was made
+	Cycle            uint64    // number of the last finished scan
+	Scanning         bool      // scan is in progress
+	LastScanStart    time.Time
+	LastScanEnd      time.Time
+	LastScanDuration time.Duration
+	LastScanRecords  int   // new records found by the last scan
+	RecordsEmitted   int64 // new records found since start
+	Sources          []SourceStatus
+	Files            []FileStatus // files read within retention window, in order of source and path
+	Dedup            DedupStats
+	Subscribers      int // subscribers and batch subscribers
+	Backlog          int // records buffered for subscribers and not received yet
+}
+
+// SourceStatus describes reachability of the log path
+type SourceStatus struct {
+	Name             string
+	Path             string
+	Reachable        bool      // the last scan listed the log path and read its files
+	LastSuccess      time.Time // the last time the log path was listed
+	LastError        string
+	LastErrorTime    time.Time
+	UnreachableSince time.Time // time of the first error in a row, zero if reachable
+	Files            int       // files read by the last scan
+}
+
+// FileStatus describes log file read by scans
+type FileStatus struct {
+	Source  string
+	Path    string
+	Size    int64 // file size at the last read, files are read whole every scan
+	Lines   int
+	Records int
+	ModTime time.Time
+	ReadAt  time.Time
+}
+
+// health collects data of Status updated by scans
+type health struct {
+	sync.Mutex
+	started     time.Time
+	scanStart   time.Time
+	scanEnd     time.Time
+	cycle       uint64
+	lastRecords int
+	records     int64
+	sources     []SourceStatus // in order of Service.sources
+	files       map[string]FileStatus
+}
+
+func newHealth(sources []Source) *health {
+	res := &health{started: time.Now(), files: make(map[string]FileStatus)}
+	res.setSources(sources)
+	return res
+}
+
+// setSources makes status of every source, status of source with the same name and path is kept,
+// files of removed sources are forgotten
+func (h *health) setSources(sources []Source) {
+	h.Lock()
+	defer h.Unlock()
+	old := make(map[string]SourceStatus, len(h.sources))
+	for _, st := range h.sources {
+		old[st.Name+"\x00"+st.Path] = st
+	}
+	h.sources = make([]SourceStatus, 0, len(sources))
+	for _, src := range sources {
+		st, ok := old[src.Name+"\x00"+src.Path]
+		if !ok {
+			st = SourceStatus{Name: src.Name, Path: src.Path}
+		}
+		h.sources = append(h.sources, st)
+	}
+	for path, file := range h.files {
+		if !h.hasSource(file.Source) {
+			delete(h.files, path)
+		}
+	}
+}
+
+func (h *health) hasSource(name string) bool {
+	for _, st := range h.sources {
+		if st.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *health) scanStarted(t time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	h.scanStart = t
+	for i := range h.sources {
+		h.sources[i].Files = 0
+	}
+}
+
+// sourceListed marks source reachable
+func (h *health) sourceListed(i int, t time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if i >= len(h.sources) {
+		return
+	}
+	h.sources[i].Reachable = true
+	h.sources[i].LastSuccess = t
+	h.sources[i].UnreachableSince = time.Time{}
+}
+
+// sourceFailed marks source unreachable
+func (h *health) sourceFailed(i int, t time.Time, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if i >= len(h.sources) {
+		return
+	}
+	st := &h.sources[i]
+	if st.UnreachableSince.IsZero() {
+		st.UnreachableSince = t
+	}
+	st.Reachable = false
+	st.LastError = err.Error()
+	st.LastErrorTime = t
+}
+
+func (h *health) fileRead(i int, file FileStatus) {
+	h.Lock()
+	defer h.Unlock()
+	h.files[file.Path] = file
+	if i < len(h.sources) {
+		h.sources[i].Files++
+	}
+}
+
+// scanFinished counts records and forgets files modified before from
+func (h *health) scanFinished(cycle uint64, t time.Time, records int, from time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	h.cycle, h.scanEnd, h.lastRecords = cycle, t, records
+	h.records += int64(records)
+	for path, file := range h.files {
+		if file.ModTime.Before(from) {
+			delete(h.files, path)
+		}
+	}
+}
+
+// Status returns scan times, reachability of sources, files read, counters and backlog of subscribers
+func (s *Service) Status() Status {
+	s.health.Lock()
+	res := Status{
+		Started:         s.health.started,
+		Cycle:           s.health.cycle,
+		Scanning:        s.health.scanStart.After(s.health.scanEnd),
+		LastScanStart:   s.health.scanStart,
+		LastScanEnd:     s.health.scanEnd,
+		LastScanRecords: s.health.lastRecords,
+		RecordsEmitted:  s.health.records,
+		Sources:         make([]SourceStatus, len(s.health.sources)),
+		Files:           make([]FileStatus, 0, len(s.health.files)),
+	}
+	copy(res.Sources, s.health.sources)
+	for _, file := range s.health.files {
+		res.Files = append(res.Files, file)
+	}
+	s.health.Unlock()
+
+	if !res.LastScanEnd.Before(res.LastScanStart) {
+		res.LastScanDuration = res.LastScanEnd.Sub(res.LastScanStart)
+	}
+	sort.Slice(res.Files, func(i, j int) bool {
+		if res.Files[i].Source != res.Files[j].Source {
+			return res.Files[i].Source < res.Files[j].Source
+		}
+		return res.Files[i].Path < res.Files[j].Path
+	})
+	res.Dedup = s.DedupStats()
+	res.Subscribers, res.Backlog = s.backlog()
+	return res
+}
+
+// backlog returns number of subscribers and records waiting in their buffers. It doesn't lock
+// subscribers, blocked delivery to a slow one holds its lock.
+func (s *Service) backlog() (subscribers, records int) {
+	s.subs.RLock()
+	defer s.subs.RUnlock()
+	for _, sub := range s.subs.list {
+		subscribers++
+		records += len(sub.ch) + int(atomic.LoadInt64(&sub.waiting))
+	}
+	for _, b := range s.subs.batchers {
+		subscribers++
+		records += len(b.in) + len(b.ch)
+	}
+	return subscribers, records
+}
+
+// healthResponse is body of health handler
+type healthResponse struct {
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+	Status   Status   `json:"status"`
+}
+
+// HealthHandler serves Status as JSON: /live responds 503 if no scan started or finished within maxAge,
+// /ready responds 503 until the first scan finished or while any log path is unreachable, /status always
+// responds 200. maxAge is 3*SleepTime+SourceTimeout if not positive. Handler matches path suffix,
+// so it can be mounted under any prefix.
+func (s *Service) HealthHandler(maxAge time.Duration) http.Handler {
+	if maxAge <= 0 {
+		s.cfgMu.RLock()
+		maxAge = 3*s.SleepTime + s.SourceTimeout
+		s.cfgMu.RUnlock()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var check func(st Status) []string
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/live"):
+			check = func(st Status) []string { return liveProblems(st, maxAge, time.Now()) }
+		case strings.HasSuffix(r.URL.Path, "/ready"):
+			check = readyProblems
+		case strings.HasSuffix(r.URL.Path, "/status"):
+			check = func(Status) []string { return nil }
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		st := s.Status()
+		res := healthResponse{Problems: check(st), Status: st}
+		res.OK = len(res.Problems) == 0
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !res.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// liveProblems reports scan loop which stopped or hung
+func liveProblems(st Status, maxAge time.Duration, now time.Time) []string {
+	last := st.Started
+	if st.LastScanStart.After(last) {
+		last = st.LastScanStart
+	}
+	if !st.Scanning && st.LastScanEnd.After(last) {
+		last = st.LastScanEnd
+	}
+	if age := now.Sub(last); age > maxAge {
+		if st.Scanning {
+			return []string{fmt.Sprintf("scan is running for %v", age.Round(time.Second))}
+		}
+		return []string{fmt.Sprintf("no scan for %v", age.Round(time.Second))}
+	}
+	return nil
+}
+
+// readyProblems reports missing first scan and unreachable log paths
+func readyProblems(st Status) []string {
+	if st.Cycle == 0 {
+		return []string{"first scan is not finished"}
+	}
+	var res []string
+	for _, src := range st.Sources {
+		if !src.Reachable {
+			res = append(res, fmt.Sprintf("%s is unreachable since %s: %s", src.Name, src.UnreachableSince.Format(time.RFC3339), src.LastError))
+		}
+	}
+	return res
+}
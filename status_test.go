@@ -0,0 +1,176 @@
+package orflog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Status(t *testing.T) {
+	dir := tempLogDir(t)
+	missing := filepath.Join(dir, "missing")
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test", missing}, Retention: 24 * 365 * 100 * time.Hour, Logger: NopLogger})
+
+	st := svc.Status()
+	assert.Equal(t, uint64(0), st.Cycle)
+	assert.False(t, st.Scanning)
+	assert.Equal(t, 2, len(st.Sources))
+	assert.False(t, st.Sources[0].Reachable)
+
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{Buffer: 10})
+	defer cancel()
+	for _, orf := range svc.GetLastRecords() {
+		svc.publish(context.Background(), 1, *orf)
+	}
+
+	st = svc.Status()
+	assert.Equal(t, uint64(1), st.Cycle)
+	assert.False(t, st.LastScanEnd.Before(st.LastScanStart))
+	assert.Equal(t, st.LastScanEnd.Sub(st.LastScanStart), st.LastScanDuration)
+	assert.Equal(t, 2, st.LastScanRecords)
+	assert.Equal(t, int64(2), st.RecordsEmitted)
+	assert.Equal(t, 2, st.Dedup.Entries)
+	assert.Equal(t, 1, st.Subscribers)
+	assert.Equal(t, 2, st.Backlog)
+	<-ch
+	assert.Equal(t, 1, svc.Status().Backlog)
+
+	assert.True(t, st.Sources[0].Reachable)
+	assert.Equal(t, 1, st.Sources[0].Files)
+	assert.False(t, st.Sources[0].LastSuccess.IsZero())
+	assert.False(t, st.Sources[1].Reachable)
+	assert.Contains(t, st.Sources[1].LastError, "missing")
+	unreachable := st.Sources[1].UnreachableSince
+	assert.False(t, unreachable.IsZero())
+
+	fi, err := os.Stat("test/test.log")
+	if !assert.NoError(t, err) || !assert.Equal(t, 1, len(st.Files)) {
+		return
+	}
+	assert.Equal(t, FileStatus{Source: "./test", Path: filepath.Join("test", "test.log"), Size: fi.Size(), Lines: 1, Records: 2,
+		ModTime: fi.ModTime(), ReadAt: st.Files[0].ReadAt}, st.Files[0])
+
+	// unreachable since the first failure, reachable again once listed
+	svc.GetLastRecords()
+	assert.Equal(t, unreachable, svc.Status().Sources[1].UnreachableSince)
+	assert.NoError(t, os.Mkdir(missing, 0700))
+	svc.GetLastRecords()
+	st = svc.Status()
+	assert.True(t, st.Sources[1].Reachable)
+	assert.True(t, st.Sources[1].UnreachableSince.IsZero())
+	assert.NotEqual(t, "", st.Sources[1].LastError, "last error is kept")
+	assert.Equal(t, int64(2), st.RecordsEmitted)
+}
+
+func TestService_StatusReplay(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test", missing}, Retention: 24 * 365 * 100 * time.Hour, Logger: NopLogger})
+
+	// replays don't change health
+	assert.NoError(t, svc.Replay(context.Background(), time.Time{}, time.Now(), func(Orf) error { return nil }))
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{Buffer: 10, Since: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)})
+	defer cancel()
+	svc.publish(context.Background(), 1, Orf{Sender: "live"})
+	assert.Equal(t, "live", (<-ch).Sender)
+
+	st := svc.Status()
+	assert.False(t, st.Sources[0].Reachable)
+	assert.True(t, st.Sources[0].LastSuccess.IsZero())
+	assert.Equal(t, "", st.Sources[1].LastError)
+	assert.Empty(t, st.Files)
+}
+
+func TestService_StatusSlowConsumer(t *testing.T) {
+	svc := NewService(Opts{Logger: NopLogger})
+	_ = svc.Channel() // never read
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.publish(ctx, 1, Orf{Sender: "blocked"})
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan Status)
+	go func() { done <- svc.Status() }()
+	select {
+	case st := <-done:
+		assert.Equal(t, 1, st.Subscribers)
+	case <-time.After(time.Second):
+		t.Fatal("status is blocked by unread Channel()")
+	}
+}
+
+func TestService_HealthHandler(t *testing.T) {
+	dir := tempLogDir(t)
+	missing := filepath.Join(dir, "missing")
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test", missing}, Retention: 24 * 365 * 100 * time.Hour, Logger: NopLogger})
+	ts := httptest.NewServer(svc.HealthHandler(time.Hour))
+	defer ts.Close()
+
+	get := func(path string) (int, healthResponse) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res healthResponse
+		if resp.StatusCode != http.StatusNotFound {
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+
+	code, res := get("/health/live")
+	assert.Equal(t, http.StatusOK, code, "just started")
+	assert.True(t, res.OK)
+	code, res = get("/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"first scan is not finished"}, res.Problems)
+
+	svc.GetLastRecords()
+	code, res = get("/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	if assert.Equal(t, 1, len(res.Problems)) {
+		assert.Contains(t, res.Problems[0], missing+" is unreachable since")
+	}
+	code, res = get("/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, uint64(1), res.Status.Cycle)
+	assert.Equal(t, int64(2), res.Status.RecordsEmitted)
+
+	assert.NoError(t, os.Mkdir(missing, 0700))
+	svc.GetLastRecords()
+	code, _ = get("/ready")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = get("/other")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLiveProblems(t *testing.T) {
+	now := time.Date(2019, 7, 6, 12, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		st   Status
+		res  []string
+		name string
+	}{
+		{Status{Started: now.Add(-time.Minute)}, nil, "started recently"},
+		{Status{Started: now.Add(-2 * time.Hour)}, []string{"no scan for 2h0m0s"}, "never scanned"},
+		{Status{Started: now.Add(-3 * time.Hour), LastScanStart: now.Add(-2 * time.Hour), LastScanEnd: now.Add(-time.Minute)}, nil, "scanned recently"},
+		{Status{Started: now.Add(-3 * time.Hour), LastScanStart: now.Add(-2 * time.Hour), LastScanEnd: now.Add(-3 * time.Hour), Scanning: true},
+			[]string{"scan is running for 2h0m0s"}, "hung scan"},
+		{Status{Started: now.Add(-3 * time.Hour), LastScanStart: now.Add(-90 * time.Minute), LastScanEnd: now.Add(-80 * time.Minute)},
+			[]string{"no scan for 1h20m0s"}, "stopped"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, liveProblems(tt.st, time.Hour, now), tt.name)
+	}
+}
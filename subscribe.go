@@ -0,0 +1,266 @@
+package orflog
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Filter selects records for subscriber, nil filter accepts all records
+type Filter func(orf Orf) bool
+
+// OverflowPolicy defines what happens with new record when subscriber's buffer is full
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	OverflowBlock      OverflowPolicy = iota // wait for subscriber, slows down delivery to all subscribers
+	OverflowDropNew                          // drop new record
+	OverflowDropOldest                       // drop the oldest buffered record to make room for new one
+)
+
+// SubscribeOpts defines buffering and start point of subscription
+type SubscribeOpts struct {
+	Buffer   int
+	Overflow OverflowPolicy
+	Since    time.Time // replay already sent records from Since, if they are still in retention window
+}
+
+// subscriber gets every record matching its filter
+type subscriber struct {
+	filter Filter
+	opts   SubscribeOpts
+	ch     chan Orf
+	done   chan struct{}
+
+	mu        sync.Mutex // guards ch against close while sending
+	stopOnce  sync.Once
+	closed    bool
+	replaying bool
+	pending   []Orf // live records received during replay
+	waiting   int64 // len(pending), read by status without mu held by blocked send
+	dropped   int64
+}
+
+// subscribers keeps all subscribers of the service
+type subscribers struct {
+	sync.RWMutex
+	list      []*subscriber
+	batchers  []*batcher
+	observers []*cycleObserver
+	legacy    *subscriber // feeds Channel() once called, nil with Opts.NoChannel
+	attached  bool        // legacy is in list
+	closed    bool
+}
+
+// Subscribe returns channel with every new record matching filter, each subscriber gets its own copy
+// of records independently of other subscribers and Channel(). Returned func cancels subscription and
+// closes the channel, channel is also closed when the service terminated.
+// With opts.Since set, records already sent since that time are replayed from log files first.
+// Channel(), once called, is fed as well and blocks delivery until read.
+func (s *Service) Subscribe(filter Filter, opts SubscribeOpts) (<-chan Orf, func()) {
+	if opts.Buffer < 0 {
+		opts.Buffer = 0
+	}
+	sub := &subscriber{
+		filter:    filter,
+		opts:      opts,
+		ch:        make(chan Orf, opts.Buffer),
+		done:      make(chan struct{}),
+		replaying: !opts.Since.IsZero(),
+	}
+
+	s.subs.Lock()
+	if s.subs.closed {
+		s.subs.Unlock()
+		sub.close()
+		return sub.ch, func() {}
+	}
+	s.subs.list = append(s.subs.list, sub)
+	s.subs.Unlock()
+
+	cancel := func() {
+		s.subs.Lock()
+		s.subs.list = removeSubscriber(s.subs.list, sub)
+		s.subs.Unlock()
+		sub.close()
+	}
+
+	if sub.replaying {
+		go s.replaySubscriber(sub)
+	}
+	return sub.ch, cancel
+}
+
+// Channel return channels with new and old records. The first call makes it an unbuffered subscriber
+// of all records published after that, delivery to all subscribers waits until it is read.
+// With Opts.NoChannel the channel is closed.
+//
+// Deprecated: use Subscribe.
+func (s *Service) Channel() (new <-chan Orf) {
+	s.subs.Lock()
+	defer s.subs.Unlock()
+	if s.subs.legacy != nil && !s.subs.attached && !s.subs.closed {
+		s.subs.list = append(s.subs.list, s.subs.legacy)
+		s.subs.attached = true
+	}
+	return s.newLogCh
+}
+
+// publish sends record of the scan cycle to all subscribers, returns early if ctx is done
+func (s *Service) publish(ctx context.Context, cycle uint64, orf Orf) {
+	s.subs.RLock()
+	list := make([]*subscriber, len(s.subs.list))
+	copy(list, s.subs.list)
+	s.subs.RUnlock()
+
+	for _, sub := range list {
+		sub.send(ctx, orf, true)
+	}
+	for _, b := range s.batchers() {
+		b.add(ctx, batchItem{cycle: cycle, orf: orf})
+	}
+}
+
+// closeSubscribers closes channels of all subscribers, Channel() included
+func (s *Service) closeSubscribers() {
+	s.subs.Lock()
+	list, batchers, legacy := s.subs.list, s.subs.batchers, s.subs.legacy
+	s.subs.list, s.subs.batchers, s.subs.legacy, s.subs.closed = nil, nil, nil, true
+	s.subs.Unlock()
+
+	for _, sub := range list {
+		sub.close()
+	}
+	if legacy != nil {
+		legacy.close() // Channel() is closed even if it was never called
+	}
+	for _, b := range batchers {
+		b.stop()
+	}
+}
+
+// replaySubscriber sends records already sent since sub.opts.Since passed through the pipeline again,
+// then records received during replay
+func (s *Service) replaySubscriber(sub *subscriber) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sub.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	replayed := make(map[string]bool)
+	for _, orf := range s.scan(ctx, modifiedAfter(sub.opts.Since), false) {
+		if orf.Time.Before(sub.opts.Since) || !s.dedup.contains(orf.HashString, orf.Time) || replayed[orf.HashString] {
+			continue
+		}
+		replayed[orf.HashString] = true
+		if !s.pipeline.run(ctx, orf) {
+			continue
+		}
+		if !sub.send(ctx, *orf, false) {
+			return
+		}
+	}
+
+	for {
+		sub.mu.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		atomic.AddInt64(&sub.waiting, -int64(len(pending)))
+		if len(pending) == 0 {
+			sub.replaying = false
+			sub.mu.Unlock()
+			return
+		}
+		sub.mu.Unlock()
+
+		for _, orf := range pending {
+			if replayed[orf.HashString] {
+				continue
+			}
+			if !sub.send(ctx, orf, false) {
+				return
+			}
+		}
+	}
+}
+
+// send delivers record to subscriber according to its overflow policy, records published during
+// replay are kept in pending. Returns false if subscriber or ctx is done.
+func (sub *subscriber) send(ctx context.Context, orf Orf, live bool) bool {
+	if sub.filter != nil && !sub.filter(orf) {
+		return true
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return false
+	}
+	if live && sub.replaying {
+		sub.pending = append(sub.pending, orf)
+		atomic.AddInt64(&sub.waiting, 1)
+		return true
+	}
+
+	switch sub.opts.Overflow {
+	case OverflowDropNew:
+		select {
+		case sub.ch <- orf:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case sub.ch <- orf:
+				return true
+			default:
+			}
+			select {
+			case <-sub.ch:
+				atomic.AddInt64(&sub.dropped, 1)
+			default:
+				if cap(sub.ch) == 0 { // nobody waits on unbuffered channel
+					atomic.AddInt64(&sub.dropped, 1)
+					return true
+				}
+			}
+		}
+	default:
+		select {
+		case sub.ch <- orf:
+		case <-sub.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// close closes subscriber's channel once, blocked send is interrupted
+func (sub *subscriber) close() {
+	sub.stopOnce.Do(func() { close(sub.done) })
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+	}
+}
+
+func removeSubscriber(list []*subscriber, sub *subscriber) []*subscriber {
+	for i, s := range list {
+		if s == sub {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,113 @@
+package orflog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Subscribe(t *testing.T) {
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}})
+
+	all, cancelAll := svc.Subscribe(nil, SubscribeOpts{Buffer: 10})
+	defer cancelAll()
+	first, cancelFirst := svc.Subscribe(func(orf Orf) bool { return orf.Recipients == "first@recipient.com" }, SubscribeOpts{Buffer: 10})
+
+	_, ok := <-svc.Channel()
+	assert.False(t, ok, "Channel is closed with NoChannel")
+
+	for _, orf := range []Orf{{Recipients: "first@recipient.com"}, {Recipients: "second@recipient.com"}} {
+		svc.publish(context.Background(), 1, orf)
+	}
+
+	assert.Equal(t, "first@recipient.com", (<-all).Recipients)
+	assert.Equal(t, "second@recipient.com", (<-all).Recipients)
+	assert.Equal(t, "first@recipient.com", (<-first).Recipients)
+	assert.Equal(t, 0, len(first))
+
+	cancelFirst()
+	_, ok = <-first
+	assert.False(t, ok, "channel closed by cancel")
+
+	svc.CloseChannels()
+	_, ok = <-all
+	assert.False(t, ok, "channel closed with service")
+}
+
+func TestService_SubscribeOverflow(t *testing.T) {
+	svc := NewService(Opts{})
+
+	dropNew, _ := svc.Subscribe(nil, SubscribeOpts{Buffer: 1, Overflow: OverflowDropNew})
+	dropOldest, _ := svc.Subscribe(nil, SubscribeOpts{Buffer: 1, Overflow: OverflowDropOldest})
+	go func() {
+		for range svc.Channel() { // Channel is fed along with subscribers
+		}
+	}()
+
+	for _, sender := range []string{"1", "2", "3"} {
+		svc.publish(context.Background(), 1, Orf{Sender: sender})
+	}
+
+	assert.Equal(t, "1", (<-dropNew).Sender)
+	assert.Equal(t, "3", (<-dropOldest).Sender)
+
+	svc.CloseChannels()
+}
+
+func TestService_SubscribeSince(t *testing.T) {
+	svc := NewService(Opts{NoChannel: true, LogPaths: []string{"./test"}, Retention: 24 * 365 * 100 * time.Hour})
+	assert.Equal(t, 2, len(svc.GetLastRecords()))
+	svc.dedup.add("live", time.Now())
+
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{Since: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)})
+	defer cancel()
+	svc.publish(context.Background(), 1, Orf{Recipients: "live@recipient.com", HashString: "live"})
+
+	var recipients []string
+	for i := 0; i < 3; i++ {
+		select {
+		case orf := <-ch:
+			recipients = append(recipients, orf.Recipients)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	assert.Equal(t, []string{"first@recipient.com", "second@recipient.com", "live@recipient.com"}, recipients)
+}
+
+func TestService_ChannelNotCalled(t *testing.T) {
+	svc := NewService(Opts{})
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{})
+	defer cancel()
+
+	go svc.publish(context.Background(), 1, Orf{Sender: "1"})
+	select {
+	case orf := <-ch:
+		assert.Equal(t, "1", orf.Sender, "not blocked by Channel() never called")
+	case <-time.After(time.Second):
+		t.Fatal("publish is blocked by Channel()")
+	}
+
+	svc.CloseChannels()
+	_, ok := <-svc.Channel()
+	assert.False(t, ok, "Channel is closed with service")
+}
+
+func TestService_ChannelWithSubscribe(t *testing.T) {
+	svc := NewService(Opts{})
+	ch, cancel := svc.Subscribe(nil, SubscribeOpts{Buffer: 1})
+	defer cancel()
+
+	legacy := svc.Channel()
+	go svc.publish(context.Background(), 1, Orf{Sender: "1"})
+	select {
+	case orf := <-legacy:
+		assert.Equal(t, "1", orf.Sender, "Channel is not detached by Subscribe")
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	assert.Equal(t, "1", (<-ch).Sender)
+	svc.CloseChannels()
+}
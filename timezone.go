@@ -0,0 +1,77 @@
+package orflog
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts lists accepted formats of ORF timestamps. Layouts with zone go first,
+// timestamps without zone are read in the time zone of the source.
+// Fractional seconds are accepted by time.Parse for all of them.
+var timeLayouts = []struct {
+	layout   string
+	withZone bool
+}{
+	{layout: time.RFC3339, withZone: true},
+	{layout: "2006-01-02T15:04:05Z0700", withZone: true},
+	{layout: "2006-01-02T15:04:05", withZone: false},
+	{layout: "2006-01-02 15:04:05", withZone: false},
+}
+
+var offsetRe = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2})(?::?(\d{2}))?$`)
+
+// loadLocation resolves time zone given as IANA name ("Europe/Moscow"), "Local", "UTC"
+// or fixed offset ("+03:00", "+0300", "UTC+3")
+func loadLocation(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	switch strings.ToLower(name) {
+	case "", "local":
+		return time.Local, nil
+	case "utc", "z":
+		return time.UTC, nil
+	}
+
+	if m := offsetRe.FindStringSubmatch(strings.ToUpper(name)); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes := 0
+		if m[3] != "" {
+			minutes, _ = strconv.Atoi(m[3])
+		}
+		if hours > 14 || minutes > 59 {
+			return nil, fmt.Errorf("invalid time zone offset %q", name)
+		}
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", name, err)
+	}
+	return loc, nil
+}
+
+// parseTime parses ORF timestamp, timestamps without offset are in loc.
+// Result is always in UTC.
+func parseTime(value string, loc *time.Location) (t time.Time, err error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	for _, l := range timeLayouts {
+		if l.withZone {
+			t, err = time.Parse(l.layout, value)
+		} else {
+			t, err = time.ParseInLocation(l.layout, value, loc)
+		}
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", value)
+}
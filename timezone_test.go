@@ -0,0 +1,66 @@
+package orflog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLocation(t *testing.T) {
+	tbl := []struct {
+		name   string
+		offset int
+	}{
+		{"UTC", 0},
+		{"+03:00", 3 * 3600},
+		{"+0300", 3 * 3600},
+		{"UTC+3", 3 * 3600},
+		{"-05:30", -(5*3600 + 30*60)},
+		{"Europe/Moscow", 3 * 3600},
+	}
+
+	for _, tt := range tbl {
+		loc, err := loadLocation(tt.name)
+		if !assert.NoError(t, err, tt.name) {
+			continue
+		}
+		_, offset := time.Date(2019, 7, 6, 10, 10, 0, 0, loc).Zone()
+		assert.Equal(t, tt.offset, offset, tt.name)
+	}
+
+	loc, err := loadLocation("Local")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Local, loc)
+
+	_, err = loadLocation("Mars/Olympus")
+	assert.Error(t, err)
+	_, err = loadLocation("+25:00")
+	assert.Error(t, err)
+}
+
+func TestParseTime(t *testing.T) {
+	msk := time.FixedZone("MSK", 3*3600)
+	want := time.Date(2019, 7, 6, 7, 10, 0, 0, time.UTC)
+
+	tbl := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2019-07-06T10:10:00", want},
+		{"2019-07-06T10:10:00.250", want.Add(250 * time.Millisecond)},
+		{"2019-07-06T07:10:00Z", want},
+		{"2019-07-06T12:10:00+05:00", want},
+		{"2019-07-06T12:10:00.5+0500", want.Add(500 * time.Millisecond)},
+	}
+
+	for _, tt := range tbl {
+		tm, err := parseTime(tt.value, msk)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, tm, tt.value)
+		assert.Equal(t, time.UTC, tm.Location(), tt.value)
+	}
+
+	_, err := parseTime("06.07.2019 10:10:00", msk)
+	assert.Error(t, err)
+}
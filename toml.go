@@ -0,0 +1,41 @@
+package orflog
+
+import (
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML decodes TOML document to the values config decoder expects: tables are map[string]interface{},
+// arrays and arrays of tables are []interface{}, integers are int64 and floats are float64
+func parseTOML(data string) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(data, &doc); err != nil {
+		return nil, err
+	}
+	return tomlValue(doc).(map[string]interface{}), nil
+}
+
+// tomlValue converts arrays of tables decoded by toml to []interface{}
+func tomlValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if val == nil {
+			val = make(map[string]interface{})
+		}
+		for k, item := range val {
+			val[k] = tomlValue(item)
+		}
+		return val
+	case []map[string]interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = tomlValue(item)
+		}
+		return res
+	case []interface{}:
+		for i, item := range val {
+			val[i] = tomlValue(item)
+		}
+		return val
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package orflog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTOML(t *testing.T) {
+	doc, err := parseTOML(`
+# comment
+title = "orf \"logs\" \u00e9" # trailing comment
+path = '\\server\logs'
+count = 1_000
+negative = -5
+rate = 0.001
+on = true
+list = [
+  "a", # first
+  "b",
+]
+empty = []
+inline = { name = "x", n = 2 }
+"quoted key" = 1
+
+[table]
+key = "value"
+[table.sub]
+key = 2
+
+[[arr]]
+n = 1
+[[arr]]
+n = 2
+[arr.nested]
+x = 1
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"title":      `orf "logs" é`,
+		"path":       `\\server\logs`,
+		"count":      int64(1000),
+		"negative":   int64(-5),
+		"rate":       0.001,
+		"on":         true,
+		"list":       []interface{}{"a", "b"},
+		"empty":      []interface{}{},
+		"inline":     map[string]interface{}{"name": "x", "n": int64(2)},
+		"quoted key": int64(1),
+		"table":      map[string]interface{}{"key": "value", "sub": map[string]interface{}{"key": int64(2)}},
+		"arr": []interface{}{
+			map[string]interface{}{"n": int64(1)},
+			map[string]interface{}{"n": int64(2), "nested": map[string]interface{}{"x": int64(1)}},
+		},
+	}, doc)
+
+	doc, err = parseTOML("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{}, doc)
+}
+
+func TestParseTOML_errors(t *testing.T) {
+	for _, doc := range []string{"a = 1\na = 2", "[t]\n[t]", "a = \"open", "a = [1, 2", "a = 1 b = 2",
+		"a = 1\n[a]", "a = [1]\n[[a]]", "x = []\n[x]", "= 1", "a = { b = 1"} {
+		_, err := parseTOML(doc)
+		assert.Error(t, err, doc)
+	}
+}
@@ -0,0 +1,342 @@
+package orflog
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// WebhookOpts defines where and how records are posted
+type WebhookOpts struct {
+	URL             string        `long:"url" env:"URL" description:"webhook url"`
+	Template        string        `long:"template" env:"TEMPLATE" default:"{{json .}}" description:"text/template of request body, executed with Orf or Batch"`
+	ContentType     string        `long:"content-type" env:"CONTENT_TYPE" default:"application/json" description:"content type of request body"`
+	Secret          string        `long:"secret" env:"SECRET" description:"HMAC-SHA256 key to sign request body, not signed if empty"`
+	SignatureHeader string        `long:"signature-header" env:"SIGNATURE_HEADER" default:"X-Orflog-Signature" description:"header with sha256=<hex signature>"`
+	Batch           bool          `long:"batch" env:"BATCH" description:"post batches instead of single records"`
+	Timeout         time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"timeout of one request"`
+	Retries         int           `long:"retries" env:"RETRIES" default:"5" description:"retries of failed request"`
+	Backoff         time.Duration `long:"backoff" env:"BACKOFF" default:"1s" description:"delay before the first retry, doubled for every next one"`
+	MaxBackoff      time.Duration `long:"max-backoff" env:"MAX_BACKOFF" default:"1m" description:"max delay between retries"`
+	DeadLetter      string        `long:"dead-letter" env:"DEAD_LETTER" description:"file to append requests failed after all retries"`
+	QueueSize       int           `long:"queue-size" env:"QUEUE_SIZE" default:"1000" description:"records or batches waiting to be posted by Run, overflow is dead-lettered"`
+
+	Client *http.Client `no-flag:"true"` // http.Client with Timeout by default
+	Logger Logger       `no-flag:"true"` // global lgr logger by default
+}
+
+// Webhook posts records rendered with template to URL. Failed requests are retried with exponential
+// backoff, requests failed after all retries or rejected with 4xx are appended to DeadLetter file
+// as JSON lines. Safe for concurrent use.
+type Webhook struct {
+	WebhookOpts
+	tmpl *template.Template
+	mu   sync.Mutex // serializes dead letter writes
+}
+
+// deadLetter is a line of DeadLetter file
+type deadLetter struct {
+	Time  time.Time `json:"time"`
+	URL   string    `json:"url"`
+	Error string    `json:"error"`
+	Body  string    `json:"body"`
+}
+
+// errPermanent wraps errors not worth retrying
+type errPermanent struct{ error }
+
+const (
+	webhookTemplate        = "{{json .}}"
+	webhookContentType     = "application/json"
+	webhookSignatureHeader = "X-Orflog-Signature"
+	webhookTimeout         = 10 * time.Second
+	webhookRetries         = 5
+	webhookBackoff         = time.Second
+	webhookMaxBackoff      = time.Minute
+	webhookQueueSize       = 1000
+)
+
+var errWebhookQueueFull = errors.New("webhook queue is full")
+
+// webhookFuncs are available in templates in addition to text/template builtins
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"time": func(layout string, t time.Time) string { return t.Format(layout) },
+}
+
+// NewWebhook makes webhook with defaults for empty opts, Retries < 0 disables retries
+func NewWebhook(opts WebhookOpts) (*Webhook, error) {
+	if opts.URL == "" {
+		return nil, errors.New("webhook url is not set")
+	}
+	if opts.Template == "" {
+		opts.Template = webhookTemplate
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = webhookContentType
+	}
+	if opts.SignatureHeader == "" {
+		opts.SignatureHeader = webhookSignatureHeader
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = webhookTimeout
+	}
+	switch {
+	case opts.Retries == 0:
+		opts.Retries = webhookRetries
+	case opts.Retries < 0:
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = webhookBackoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = webhookMaxBackoff
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = webhookQueueSize
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(opts.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+	return &Webhook{WebhookOpts: opts, tmpl: tmpl}, nil
+}
+
+// Run posts records of the service matching filter until ctx is done or the service terminated,
+// records or batches failed to post are dead-lettered and don't stop the run. Records are posted by
+// a separate worker from queue of QueueSize, so retries don't hold the service; records not fitting
+// the queue are dead-lettered without posting, as well as records left in the queue when ctx is done.
+func (w *Webhook) Run(ctx context.Context, svc *Service, filter Filter) {
+	queue := make(chan interface{}, w.QueueSize)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(queue)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.worker(ctx, queue)
+	}()
+
+	if w.Batch {
+		ch, cancel := svc.SubscribeBatches(filter, BatchOpts{})
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case batch, ok := <-ch:
+				if !ok {
+					return
+				}
+				w.enqueue(queue, batch)
+			}
+		}
+	}
+
+	ch, cancel := svc.Subscribe(filter, SubscribeOpts{})
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case orf, ok := <-ch:
+			if !ok {
+				return
+			}
+			w.enqueue(queue, orf)
+		}
+	}
+}
+
+// enqueue passes record or batch to the worker, dead-letters it if the queue is full
+func (w *Webhook) enqueue(queue chan<- interface{}, data interface{}) {
+	select {
+	case queue <- data:
+		return
+	default:
+	}
+	msg, fields := webhookLogFields(data, errWebhookQueueFull)
+	w.Logger.Warn(msg, fields...)
+	w.deadLetterData(data, errWebhookQueueFull)
+}
+
+// worker posts queued records and batches until the queue is closed, dead-letters them after ctx is done
+func (w *Webhook) worker(ctx context.Context, queue <-chan interface{}) {
+	left := 0
+	for data := range queue {
+		if ctx.Err() != nil {
+			w.deadLetterData(data, ctx.Err())
+			left++
+			continue
+		}
+		if err := w.send(ctx, data); err != nil && ctx.Err() == nil {
+			msg, fields := webhookLogFields(data, err)
+			w.Logger.Warn(msg, fields...)
+		}
+	}
+	if left > 0 {
+		w.Logger.Warn("webhook queue dead-lettered on shutdown", "queued", left, "path", w.DeadLetter)
+	}
+}
+
+// deadLetterData renders and dead-letters record or batch not posted
+func (w *Webhook) deadLetterData(data interface{}, reason error) {
+	body, err := w.render(data)
+	if err == nil {
+		err = w.deadLetter(body, reason)
+	}
+	if err != nil {
+		w.Logger.Warn("could not write dead letter", "path", w.DeadLetter, "error", err)
+	}
+}
+
+// webhookLogFields returns warning and its fields about record or batch failed to post
+func webhookLogFields(data interface{}, err error) (string, []interface{}) {
+	if batch, ok := data.(Batch); ok {
+		return "could not post batch", []interface{}{"cycle", batch.Cycle, "source", batch.Source, "records", len(batch.Records), "error", err}
+	}
+	orf, _ := data.(Orf)
+	return "could not post record", []interface{}{"hash", orf.HashString, "error", err}
+}
+
+// Send posts record
+func (w *Webhook) Send(ctx context.Context, orf Orf) error {
+	return w.send(ctx, orf)
+}
+
+// SendBatch posts batch with template executed for the whole batch
+func (w *Webhook) SendBatch(ctx context.Context, batch Batch) error {
+	return w.send(ctx, batch)
+}
+
+// send renders and posts data, body is dead-lettered if post failed or was interrupted by ctx
+func (w *Webhook) send(ctx context.Context, data interface{}) error {
+	body, err := w.render(data)
+	if err != nil {
+		return err
+	}
+
+	err = w.post(ctx, body)
+	if err != nil {
+		if dlErr := w.deadLetter(body, err); dlErr != nil {
+			w.Logger.Warn("could not write dead letter", "path", w.DeadLetter, "error", dlErr)
+		}
+	}
+	return err
+}
+
+// render executes template with record or batch
+func (w *Webhook) render(data interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	if err := w.tmpl.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("could not render webhook body: %v", err)
+	}
+	return body.Bytes(), nil
+}
+
+// post sends body with retries
+func (w *Webhook) post(ctx context.Context, body []byte) error {
+	delay := w.Backoff
+	for attempt := 0; ; attempt++ {
+		err := w.request(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(errPermanent); ok || attempt >= w.Retries {
+			return err
+		}
+		w.Logger.Debug("webhook attempt failed", "attempt", attempt+1, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > w.MaxBackoff {
+			delay = w.MaxBackoff
+		}
+	}
+}
+
+// request makes one request, 4xx except 408 and 429 are permanent errors
+func (w *Webhook) request(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.ContentType)
+	if w.Secret != "" {
+		req.Header.Set(w.SignatureHeader, "sha256="+Sign([]byte(w.Secret), body))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	// drain body to reuse connection
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return errPermanent{fmt.Errorf("webhook responded %s", resp.Status)}
+	}
+}
+
+// deadLetter appends failed body to DeadLetter file
+func (w *Webhook) deadLetter(body []byte, reason error) error {
+	if w.DeadLetter == "" {
+		return nil
+	}
+	line, err := json.Marshal(deadLetter{Time: time.Now(), URL: w.URL, Error: reason.Error(), Body: string(body)})
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.OpenFile(w.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Sign returns hex HMAC-SHA256 of body, receivers compare it with the signature header value after "sha256="
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
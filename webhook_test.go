@@ -0,0 +1,197 @@
+package orflog
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var bodies []string
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+		assert.Equal(t, "sha256="+Sign([]byte("secret"), body), r.Header.Get("X-Orflog-Signature"))
+		switch {
+		case strings.Contains(string(body), "bad"):
+			w.WriteHeader(http.StatusBadRequest)
+		case strings.Contains(string(body), "down"), calls < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			bodies = append(bodies, string(body))
+		}
+	}))
+	defer ts.Close()
+
+	deadLetters := filepath.Join(dir, "dead.jsonl")
+	wh, err := NewWebhook(WebhookOpts{URL: ts.URL, Template: "{{.Action}} {{.Sender}} {{time \"2006-01-02\" .Time}}",
+		ContentType: "text/plain", Secret: "secret", Retries: 3, Backoff: time.Millisecond, DeadLetter: deadLetters})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, wh.Send(ctx, Orf{Action: "reject", Sender: "a@example.com", Time: time.Date(2019, 7, 6, 0, 0, 0, 0, time.UTC)}))
+	assert.Equal(t, []string{"reject a@example.com 2019-07-06"}, bodies)
+	assert.Equal(t, 3, calls, "retried twice")
+
+	calls = 0
+	assert.Error(t, wh.Send(ctx, Orf{Sender: "bad@example.com"}))
+	assert.Equal(t, 1, calls, "4xx is not retried")
+	calls = 0
+	assert.Error(t, wh.Send(ctx, Orf{Sender: "down@example.com"}))
+	assert.Equal(t, 4, calls)
+
+	data, err := ioutil.ReadFile(deadLetters)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Equal(t, 2, len(lines)) {
+		var dl deadLetter
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &dl))
+		assert.Equal(t, " down@example.com 0001-01-01", dl.Body)
+		assert.Equal(t, "webhook responded 503 Service Unavailable", dl.Error)
+	}
+
+	_, err = NewWebhook(WebhookOpts{URL: ts.URL, Template: "{{.Action"})
+	assert.Error(t, err)
+	_, err = NewWebhook(WebhookOpts{})
+	assert.Error(t, err)
+}
+
+func TestWebhook_Run(t *testing.T) {
+	received := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookOpts{URL: ts.URL, Batch: true, Template: "{{.Source}}:{{range .Records}} {{.Sender}}{{end}}"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	svc := NewService(Opts{NoChannel: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wh.Run(ctx, svc, nil)
+		close(done)
+	}()
+
+	// wait for subscription
+	for {
+		svc.subs.RLock()
+		n := len(svc.subs.batchers)
+		svc.subs.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	svc.publish(ctx, 1, Orf{Source: "orf01", Sender: "1"})
+	svc.publish(ctx, 1, Orf{Source: "orf01", Sender: "2"})
+	svc.flushBatches(ctx, 1)
+
+	select {
+	case body := <-received:
+		assert.Equal(t, "orf01: 1 2", body)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	cancel()
+	<-done
+}
+
+func TestWebhook_RunQueueFull(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+	deadLetters := filepath.Join(dir, "dead.jsonl")
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookOpts{URL: ts.URL, Template: "{{.Sender}}", QueueSize: 1, DeadLetter: deadLetters, Logger: NopLogger})
+	if !assert.NoError(t, err) {
+		return
+	}
+	svc := NewService(Opts{NoChannel: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wh.Run(ctx, svc, nil)
+		close(done)
+	}()
+	for {
+		svc.subs.RLock()
+		n := len(svc.subs.list)
+		svc.subs.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// endpoint is stuck, publish is not
+	published := make(chan struct{})
+	go func() {
+		for _, sender := range []string{"1", "2", "3", "4", "5"} {
+			svc.publish(ctx, 1, Orf{Sender: sender})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish is blocked by webhook")
+	}
+
+	var lines []string
+	for deadline := time.Now().Add(time.Second); len(lines) < 3 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(deadLetters)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	if assert.True(t, len(lines) >= 3, "records over the queue are dead-lettered: %v", lines) {
+		var dl deadLetter
+		assert.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &dl))
+		assert.Equal(t, "webhook queue is full", dl.Error)
+		assert.Equal(t, "5", dl.Body)
+	}
+
+	cancel()
+	close(release)
+	<-done
+
+	// in-flight and queued records are dead-lettered on shutdown
+	data, err := ioutil.ReadFile(deadLetters)
+	assert.NoError(t, err)
+	senders := make([]string, 0, 5)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var dl deadLetter
+		assert.NoError(t, json.Unmarshal([]byte(line), &dl))
+		senders = append(senders, dl.Body)
+	}
+	sort.Strings(senders)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, senders)
+}
@@ -0,0 +1,52 @@
+package orflog
+
+import (
+	"time"
+)
+
+// window keeps time bounds of records tracked by the service
+type window struct {
+	from    time.Time // records before from are forgotten by dedup
+	to      time.Time // time of the last scan
+	started bool      // first scan (backfill) completed
+}
+
+// Window returns bounds of records tracked by the service: records with time after from are
+// remembered to skip duplicates, to is the time of the last scan. Before the first scan
+// bounds are calculated for the current time.
+func (s *Service) Window() (from, to time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.window.started {
+		now := time.Now()
+		return s.retentionStart(now), now
+	}
+	return s.window.from, s.window.to
+}
+
+// retentionStart returns start of the retention window for now, Retention wins over TimeRange
+func (s *Service) retentionStart(now time.Time) time.Time {
+	if s.Retention > 0 {
+		return now.Add(-s.Retention)
+	}
+	return now.AddDate(-s.TimeRange.Years, -s.TimeRange.Months, -s.TimeRange.Days)
+}
+
+// scanBounds returns bounds for the next scan at now, must be called under mu: records before keepFrom are dropped from dedup,
+// records before emitFrom are not sent. emitFrom differs from keepFrom only on the first scan with Backfill set.
+func (s *Service) scanBounds(now time.Time) (keepFrom, emitFrom time.Time) {
+	keepFrom = s.retentionStart(now)
+	emitFrom = keepFrom
+	if !s.window.started && s.Backfill > 0 {
+		emitFrom = now.Add(-s.Backfill)
+	}
+	return keepFrom, emitFrom
+}
+
+// earliest returns the earliest of times
+func earliest(t1, t2 time.Time) time.Time {
+	if t2.Before(t1) {
+		return t2
+	}
+	return t1
+}
@@ -0,0 +1,59 @@
+package orflog
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Window(t *testing.T) {
+	svc := NewService(Opts{Retention: 48 * time.Hour})
+	from, to := svc.Window()
+	assert.InDelta(t, 48*time.Hour, to.Sub(from), float64(time.Second))
+
+	svc = NewService(Opts{})
+	from, to = svc.Window()
+	assert.Equal(t, to.AddDate(0, -1, 0), from)
+}
+
+func TestService_getNewRecordsBackfill(t *testing.T) {
+	dir := tempLogDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	lines := []string{
+		orfLogLine(now.Add(-40*24*time.Hour), "old@sender.com"),
+		orfLogLine(now.Add(-30*time.Hour), "day@sender.com"),
+		orfLogLine(now.Add(-2*time.Hour), "hour@sender.com"),
+	}
+	writeLog(t, dir, "orf.log", strings.Join(lines, "\r\n"))
+
+	senders := func(orfs []*Orf, _ uint64) (res []string) {
+		for _, orf := range orfs {
+			res = append(res, orf.Sender)
+		}
+		return res
+	}
+
+	svc := NewService(Opts{LogPaths: []string{dir}, Retention: 48 * time.Hour, Backfill: 3 * time.Hour})
+	assert.Equal(t, []string{"hour@sender.com"}, senders(svc.getNewRecords(context.Background())))
+	assert.Empty(t, senders(svc.getNewRecords(context.Background())), "day record is remembered, not sent")
+	from, to := svc.Window()
+	assert.Equal(t, 48*time.Hour, to.Sub(from))
+
+	svc = NewService(Opts{LogPaths: []string{dir}, Retention: 48 * time.Hour, Backfill: 60 * 24 * time.Hour})
+	assert.Equal(t, []string{"old@sender.com", "day@sender.com", "hour@sender.com"}, senders(svc.getNewRecords(context.Background())))
+	assert.Empty(t, senders(svc.getNewRecords(context.Background())), "old record is outside of retention")
+
+	svc = NewService(Opts{LogPaths: []string{dir}})
+	assert.Equal(t, []string{"day@sender.com", "hour@sender.com"}, senders(svc.getNewRecords(context.Background())))
+	assert.Empty(t, senders(svc.getNewRecords(context.Background())))
+}
+
+func orfLogLine(tm time.Time, sender string) string {
+	return "SMTPSVC " + tm.Format(time.RFC3339) + " 2 3 Reject BeforeArrival 10.10.10.10 " + sender + " r@r.com 9 10 11 msg"
+}